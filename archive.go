@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+
+// writeSnapshotArchive streams the files as a tar.gz into w. The files are absolute
+// paths under basePath and are stored relative to it.
+func writeSnapshotArchive(w io.Writer, basePath string, files []string) error {
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+
+	for _, p := range files {
+		rel, err := filepath.Rel(basePath, p)
+		if err != nil {
+			return errors.Wrap(err, "filepath error")
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return errors.Wrap(err, "os error")
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return errors.Wrap(err, "os error")
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			f.Close()
+			return errors.Wrap(err, "tar error")
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			f.Close()
+			return errors.Wrap(err, "tar error")
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return errors.Wrap(err, "tar error")
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "tar error")
+	}
+	if err := gzw.Close(); err != nil {
+		return errors.Wrap(err, "gzip error")
+	}
+	return nil
+}
+
+
+// extractSnapshotArchive unpacks a tar.gz read from r into destPath.
+func extractSnapshotArchive(r io.Reader, destPath string) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "gzip error")
+	}
+	defer gzr.Close()
+	tr := tar.NewReader(gzr)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "tar error")
+		}
+
+		outPath := filepath.Join(destPath, filepath.FromSlash(hdr.Name))
+		if outPath != destPath && ! strings.HasPrefix(outPath, destPath + string(filepath.Separator)) {
+			return errors.New("illegal path in archive: " + hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(outPath, 0777)
+			if err != nil {
+				return errors.Wrap(err, "os error")
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			err = os.MkdirAll(filepath.Dir(outPath), 0777)
+			if err != nil {
+				return errors.Wrap(err, "os error")
+			}
+			f, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode) | 0600)
+			if err != nil {
+				return errors.Wrap(err, "os error")
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return errors.Wrap(err, "tar error")
+			}
+		}
+	}
+
+	return nil
+}
+
+
+// downloadSnapshotArchive streams a snapshot saved as a tar.gz into a fresh
+// directory at destPath. Snapshots were saved this way before snapshot trees.
+func downloadSnapshotArchive(store Store, objectName, expectedHash, destPath string) error {
+	rc, err := store.NewReader(objectName)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	os.RemoveAll(destPath)
+	err = os.MkdirAll(destPath, 0777)
+	if err != nil {
+		return errors.Wrap(err, "os error")
+	}
+
+	h := sha256.New()
+	tr := io.TeeReader(rc, h)
+	err = extractSnapshotArchive(tr, destPath)
+	if err != nil {
+		os.RemoveAll(destPath)
+		return err
+	}
+	// the gzip reader may stop before the end of the object.
+	_, err = io.Copy(io.Discard, tr)
+	if err != nil {
+		return errors.Wrap(err, "storage error")
+	}
+	if expectedHash != "" && fmt.Sprintf("%x", h.Sum(nil)) != expectedHash {
+		os.RemoveAll(destPath)
+		return errors.New(objectName + " is corrupted: hash mismatch")
+	}
+	return nil
+}
+
+
+// copyObject copies one object to another name without holding it in memory.
+func copyObject(store Store, fromName, toName string) error {
+	rc, err := store.NewReader(fromName)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	wc, err := store.NewWriter(toName)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(wc, rc)
+	if err != nil {
+		wc.Abort()
+		return errors.Wrap(err, "storage error")
+	}
+	return wc.Close()
+}
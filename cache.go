@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+// Unpacked snapshots are kept under <root>/cache/<project>/<email>/ across runs, so
+// viewing, diffing, merging and reverting do not download the same snapshot
+// again. cache/index.json records each entry's hash, folder, files, size and last
+// use and the least recently used entries are removed when the cache grows past
+// the limit in the settings.
+//
+// The files may be opened from the snapshot pages and changed by mistake, so they
+// are checked on every use. Only files whose size or modification time changed
+// are hashed again.
+type CacheEntry struct {
+	Hash string `json:"hash"`
+	// Dir is the folder of the files relative to the cache folder. Entries made
+	// before it was recorded are at their key.
+	Dir string `json:"dir"`
+	Files map[string]CachedFile `json:"files"`
+	Size int64 `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+type CachedFile struct {
+	Size int64 `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash string `json:"hash"`
+}
+
+const DefaultCacheLimitMB = 2048
+
+// cacheMutex guards index.json and the maps below. It is never held during a
+// download, so a big snapshot only holds up the requests for that snapshot.
+var cacheMutex sync.Mutex
+
+// cachePins counts the requests using each cache folder. Pinned folders are not
+// removed until the last of them is done; retiredDirs are the pinned folders of
+// entries that were replaced, removed on their last release.
+var cachePins = make(map[string]int)
+var retiredDirs = make(map[string]bool)
+
+// snapshotMutexes let one request at a time check or download each snapshot.
+var snapshotMutexes = make(map[string]*sync.Mutex)
+
+
+func getCachePath() string {
+	rootPath, _ := GetRootPath()
+	return filepath.Join(rootPath, "cache")
+}
+
+
+func readCacheIndex() (map[string]CacheEntry, error) {
+	index := make(map[string]CacheEntry)
+	indexPath := filepath.Join(getCachePath(), "index.json")
+	if ! DoesPathExists(indexPath) {
+		return index, nil
+	}
+	raw, err := os.ReadFile(indexPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "os error")
+	}
+	err = json.Unmarshal(raw, &index)
+	if err != nil {
+		// a broken index only costs downloads, so start over.
+		emptyDir(getCachePath())
+		return make(map[string]CacheEntry), nil
+	}
+	return index, nil
+}
+
+
+func writeCacheIndex(index map[string]CacheEntry) error {
+	jsonBytes, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "json error")
+	}
+	os.MkdirAll(getCachePath(), 0777)
+	err = os.WriteFile(filepath.Join(getCachePath(), "index.json"), jsonBytes, 0777)
+	if err != nil {
+		return errors.Wrap(err, "os error")
+	}
+	return nil
+}
+
+
+func getCacheLimit() int64 {
+	settings, err := getSettings()
+	if err != nil {
+		return DefaultCacheLimitMB * 1024 * 1024
+	}
+	limitMB, err := strconv.ParseInt(settings["cache_limit_mb"], 10, 64)
+	if err != nil || limitMB < 0 {
+		return DefaultCacheLimitMB * 1024 * 1024
+	}
+	return limitMB * 1024 * 1024
+}
+
+
+// recordCachedFiles returns the size, modification time and hash of every file
+// under dirPath, and their total size.
+func recordCachedFiles(dirPath string) (map[string]CachedFile, int64, error) {
+	paths, err := getAllFilesList(dirPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	files := make(map[string]CachedFile)
+	var total int64
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "os error")
+		}
+		hash, _, err := hashFileChunks(p)
+		if err != nil {
+			return nil, 0, err
+		}
+		files[strings.Replace(p, dirPath + "/", "", 1)] = CachedFile{fi.Size(), fi.ModTime(), hash}
+		total += fi.Size()
+	}
+	return files, total, nil
+}
+
+
+// checkCachedFiles reports if the files under dirPath are still the recorded ones.
+// Files that were only touched get their new time recorded in files.
+func checkCachedFiles(dirPath string, files map[string]CachedFile) bool {
+	paths, err := getAllFilesList(dirPath)
+	if err != nil || len(paths) != len(files) {
+		return false
+	}
+	for _, p := range paths {
+		shortPath := strings.Replace(p, dirPath + "/", "", 1)
+		recorded, ok := files[shortPath]
+		if ! ok {
+			return false
+		}
+		fi, err := os.Stat(p)
+		if err != nil || fi.Size() != recorded.Size {
+			return false
+		}
+		if fi.ModTime().Equal(recorded.ModTime) {
+			continue
+		}
+		hash, _, err := hashFileChunks(p)
+		if err != nil || hash != recorded.Hash {
+			return false
+		}
+		recorded.ModTime = fi.ModTime()
+		files[shortPath] = recorded
+	}
+	return true
+}
+
+
+func entryDir(key string, entry CacheEntry) string {
+	if entry.Dir == "" {
+		return key
+	}
+	return entry.Dir
+}
+
+
+// removeCacheDir removes a cache folder now, or on its last release when it is
+// pinned. cacheMutex must be held.
+func removeCacheDir(dir string) {
+	if cachePins[dir] > 0 {
+		retiredDirs[dir] = true
+		return
+	}
+	os.RemoveAll(filepath.Join(getCachePath(), filepath.FromSlash(dir)))
+}
+
+
+// evictFromCache removes the least recently used entries until the cache fits
+// the limit. Pinned entries are never removed. cacheMutex must be held.
+func evictFromCache(index map[string]CacheEntry, limit int64) {
+	keys := make([]string, 0, len(index))
+	var total int64
+	for key, entry := range index {
+		keys = append(keys, key)
+		total += entry.Size
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return index[keys[i]].LastUsed.Before(index[keys[j]].LastUsed)
+	})
+
+	for _, key := range keys {
+		if total <= limit {
+			break
+		}
+		if cachePins[entryDir(key, index[key])] > 0 {
+			continue
+		}
+		removeCacheDir(entryDir(key, index[key]))
+		total -= index[key].Size
+		delete(index, key)
+	}
+}
+
+
+// getCachedSnapshot returns the path of a snapshot's unpacked files, downloading
+// the snapshot only when the cache does not have it at the expected hash or the
+// files were changed. The files must be treated as read only.
+//
+// The files are pinned until the returned release is called, so callers keep them
+// for as long as they use them with defer release().
+func getCachedSnapshot(store Store, projectName, email, snapshotName, expectedHash string) (string, func(), error) {
+	key := projectName + "/" + email + "/" + snapshotName
+
+	cacheMutex.Lock()
+	snapshotMutex, ok := snapshotMutexes[key]
+	if ! ok {
+		snapshotMutex = &sync.Mutex{}
+		snapshotMutexes[key] = snapshotMutex
+	}
+	cacheMutex.Unlock()
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	cacheMutex.Lock()
+	index, err := readCacheIndex()
+	if err != nil {
+		cacheMutex.Unlock()
+		return "", nil, err
+	}
+	entry, ok := index[key]
+	usable := ok && entry.Files != nil && (expectedHash == "" || entry.Hash == expectedHash)
+	if usable {
+		// pinned before letting go of the lock, so it is not evicted while checked.
+		cachePins[entry.Dir] += 1
+	}
+	cacheMutex.Unlock()
+
+	if usable {
+		dirPath := filepath.Join(getCachePath(), filepath.FromSlash(entry.Dir))
+		release := releaseCachedSnapshot(entry.Dir)
+		if checkCachedFiles(dirPath, entry.Files) {
+			cacheMutex.Lock()
+			index, err = readCacheIndex()
+			if current, ok := index[key]; err == nil && ok && current.Dir == entry.Dir {
+				current.Files = entry.Files
+				current.LastUsed = time.Now()
+				index[key] = current
+				err = writeCacheIndex(index)
+			}
+			cacheMutex.Unlock()
+			if err != nil {
+				release()
+				return "", nil, err
+			}
+			return dirPath, release, nil
+		}
+		release()
+	}
+
+	// downloaded outside the cache and moved in when complete.
+	rootPath, _ := GetRootPath()
+	tmpPath := filepath.Join(rootPath, "flotmp", UntestedRandomString(10))
+	err = downloadSnapshot(store, email, snapshotName, expectedHash, tmpPath)
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return "", nil, err
+	}
+	files, size, err := recordCachedFiles(tmpPath)
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return "", nil, err
+	}
+	dir := key + "." + UntestedRandomString(6)
+	dirPath := filepath.Join(getCachePath(), filepath.FromSlash(dir))
+	os.MkdirAll(filepath.Dir(dirPath), 0777)
+	err = os.Rename(tmpPath, dirPath)
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return "", nil, errors.Wrap(err, "os error")
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	index, err = readCacheIndex()
+	if err != nil {
+		os.RemoveAll(dirPath)
+		return "", nil, err
+	}
+	if old, ok := index[key]; ok {
+		removeCacheDir(entryDir(key, old))
+	}
+	index[key] = CacheEntry{expectedHash, dir, files, size, time.Now()}
+	cachePins[dir] += 1
+	evictFromCache(index, getCacheLimit())
+	return dirPath, releaseCachedSnapshot(dir), writeCacheIndex(index)
+}
+
+
+// releaseCachedSnapshot returns the function that unpins a cache folder, after
+// which the cache is brought back within its limit.
+func releaseCachedSnapshot(dir string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cacheMutex.Lock()
+			defer cacheMutex.Unlock()
+
+			cachePins[dir] -= 1
+			if cachePins[dir] <= 0 {
+				delete(cachePins, dir)
+				if retiredDirs[dir] {
+					delete(retiredDirs, dir)
+					os.RemoveAll(filepath.Join(getCachePath(), filepath.FromSlash(dir)))
+				}
+			}
+			index, err := readCacheIndex()
+			if err != nil {
+				return
+			}
+			evictFromCache(index, getCacheLimit())
+			writeCacheIndex(index)
+		})
+	}
+}
+
+
+func clearCache() error {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	if ! DoesPathExists(getCachePath()) {
+		return nil
+	}
+	if len(cachePins) == 0 {
+		return emptyDir(getCachePath())
+	}
+	// entries in use stay until they are released.
+	index, err := readCacheIndex()
+	if err != nil {
+		return err
+	}
+	evictFromCache(index, 0)
+	return writeCacheIndex(index)
+}
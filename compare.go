@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+
+// FileChange is a file that differs between two versions of a project. Diff is
+// set for changed text files and Binary for other changed files, including
+// renamed files whose contents changed.
+type FileChange struct {
+	Path string
+	// Status is "added", "changed", "deleted" or "renamed".
+	Status string
+	// OldPath and Similarity are set for renamed files.
+	OldPath string
+	Similarity int
+	Diff *FileDiff
+	Binary *BinaryChange
+	ID string
+}
+
+
+// compareTrees returns the files that differ between the unpacked versions at
+// oldPath and newPath, sorted by path.
+func compareTrees(oldPath, newPath string) ([]FileChange, error) {
+	newFiles, err := getAllFilesList(newPath)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := compareFiles(oldPath, newPath, newFiles)
+	if err != nil {
+		return nil, err
+	}
+	return addRenames(oldPath, newPath, changes)
+}
+
+
+// compareWorkingTree returns the files of the project folder that differ from the
+// snapshot unpacked at snapshotPath. Excluded files are left out on both sides.
+func compareWorkingTree(projectName, snapshotPath string) ([]FileChange, error) {
+	rootPath, _ := GetRootPath()
+	newFiles, err := getCleanFilesList(projectName)
+	if err != nil {
+		return nil, err
+	}
+	exRules, err := getExclusionRules(projectName)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := compareFiles(snapshotPath, filepath.Join(rootPath, "p", projectName), newFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make([]FileChange, 0, len(changes))
+	for _, change := range changes {
+		if checkExrulesDir(change.Path, exRules) && checkExrulesExtensions(change.Path, exRules) &&
+			checkExrulesFiles(change.Path, exRules) {
+			kept = append(kept, change)
+		}
+	}
+	return addRenames(snapshotPath, filepath.Join(rootPath, "p", projectName), kept)
+}
+
+
+// compareFiles compares the unpacked version at oldPath with the files newFiles
+// (absolute paths under newPath), which stand for all of the newer version.
+func compareFiles(oldPath, newPath string, newFiles []string) ([]FileChange, error) {
+	oldFiles, err := getAllFilesList(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	shortPaths := make(map[string]bool)
+	inNewFiles := make(map[string]bool)
+	for _, p := range oldFiles {
+		shortPaths[strings.Replace(p, oldPath + "/", "", 1)] = true
+	}
+	for _, p := range newFiles {
+		shortPath := strings.Replace(p, newPath + "/", "", 1)
+		shortPaths[shortPath] = true
+		inNewFiles[shortPath] = true
+	}
+
+	changes := make([]FileChange, 0)
+	for shortPath := range shortPaths {
+		rawOld, inOld, err := readMergeFile(oldPath, shortPath)
+		if err != nil {
+			return nil, err
+		}
+		var rawNew []byte
+		inNew := inNewFiles[shortPath]
+		if inNew {
+			rawNew, _, err = readMergeFile(newPath, shortPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		change := FileChange{Path: shortPath, ID: makeHTMLFriendly(shortPath)}
+		switch {
+		case ! inOld:
+			change.Status = "added"
+		case ! inNew:
+			change.Status = "deleted"
+		case ! bytes.Equal(rawOld, rawNew):
+			change.Status = "changed"
+			setChangeDiff(&change, rawOld, rawNew)
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+
+func setChangeDiff(change *FileChange, rawOld, rawNew []byte) {
+	if isTextFile(rawOld) && isTextFile(rawNew) {
+		change.Diff = makeFileDiff(change.Path, string(rawOld), string(rawNew))
+	} else {
+		change.Binary = makeBinaryChange(rawOld, rawNew)
+	}
+}
+
+
+// addRenames replaces the deleted and added files of changes that are the same
+// file moved with a renamed entry.
+func addRenames(oldPath, newPath string, changes []FileChange) ([]FileChange, error) {
+	deleted := make([]string, 0)
+	added := make([]string, 0)
+	for _, change := range changes {
+		switch change.Status {
+		case "deleted":
+			deleted = append(deleted, change.Path)
+		case "added":
+			added = append(added, change.Path)
+		}
+	}
+	renames, err := findRenames(oldPath, deleted, newPath, added, getRenameThreshold())
+	if err != nil || len(renames) == 0 {
+		return changes, err
+	}
+
+	renamed := make(map[string]bool)
+	for _, rename := range renames {
+		renamed[rename.OldPath] = true
+		renamed[rename.NewPath] = true
+	}
+	kept := make([]FileChange, 0, len(changes))
+	for _, change := range changes {
+		if (change.Status == "deleted" || change.Status == "added") && renamed[change.Path] {
+			continue
+		}
+		kept = append(kept, change)
+	}
+	for _, rename := range renames {
+		change := FileChange{Path: rename.NewPath, Status: "renamed", OldPath: rename.OldPath,
+			Similarity: rename.Similarity, ID: makeHTMLFriendly(rename.NewPath)}
+		if rename.Similarity < 100 {
+			rawOld, _, err := readMergeFile(oldPath, rename.OldPath)
+			if err != nil {
+				return nil, err
+			}
+			rawNew, _, err := readMergeFile(newPath, rename.NewPath)
+			if err != nil {
+				return nil, err
+			}
+			if ! bytes.Equal(rawOld, rawNew) {
+				setChangeDiff(&change, rawOld, rawNew)
+			}
+		}
+		kept = append(kept, change)
+	}
+
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].Path < kept[j].Path
+	})
+	return kept, nil
+}
+
+
+// compareSnapshots shows what changed from snapshot A to snapshot B. Either may
+// belong to any member.
+func compareSnapshots(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectName := vars["proj"]
+
+	pd, err := getProjectData(projectName)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	store, err := getStore(pd)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	projects, err := getAllProjects()
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+
+	unpackedPaths := make([]string, 0, 2)
+	compared := make([]Snapshot, 0, 2)
+	for _, ref := range []SnapshotRef{{vars["emailA"], vars["snapA"]}, {vars["emailB"], vars["snapB"]}} {
+		snapshots, err := getManifest(store, ref.Email)
+		if err != nil {
+			errorPage(w, err)
+			return
+		}
+		snapshot := findSnapshot(snapshots, ref.Name)
+		if snapshot == nil {
+			errorPage(w, errors.New("The snapshot " + ref.Name + " of " + ref.Email + " does not exist."))
+			return
+		}
+		unpackedPath, release, err := getCachedSnapshot(store, projectName, ref.Email, ref.Name, snapshot.Hash)
+		if err != nil {
+			errorPage(w, err)
+			return
+		}
+		defer release()
+		unpackedPaths = append(unpackedPaths, unpackedPath)
+		compared = append(compared, *snapshot)
+	}
+
+	changes, err := compareTrees(unpackedPaths[0], unpackedPaths[1])
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+
+	type Context struct {
+		Projects []string
+		CurrentProject string
+		A Snapshot
+		B Snapshot
+		WorkingTree bool
+		Changes []FileChange
+		SnapshotTime func(s string) string
+	}
+	st := func(s string) string {
+		timeParsed, err :=  time.Parse(VersionFormat, s)
+		if err != nil {
+			return ""
+		}
+		return timeParsed.String()
+	}
+	tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/compare.html", "templates/diff.html"))
+	tmpl.Execute(w, Context{projects, projectName, compared[0], compared[1], false, changes, st})
+}
+
+
+// compareWithWorkingTree shows how the project folder differs from a snapshot of
+// any member.
+func compareWithWorkingTree(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectName := vars["proj"]
+	email := vars["email"]
+	snapshotName := vars["sname"]
+
+	pd, err := getProjectData(projectName)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	store, err := getStore(pd)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	projects, err := getAllProjects()
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+
+	snapshots, err := getManifest(store, email)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	snapshot := findSnapshot(snapshots, snapshotName)
+	if snapshot == nil {
+		errorPage(w, errors.New("The snapshot " + snapshotName + " of " + email + " does not exist."))
+		return
+	}
+	unpackedPath, release, err := getCachedSnapshot(store, projectName, email, snapshotName, snapshot.Hash)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	defer release()
+	changes, err := compareWorkingTree(projectName, unpackedPath)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+
+	type Context struct {
+		Projects []string
+		CurrentProject string
+		A Snapshot
+		WorkingTree bool
+		Changes []FileChange
+		SnapshotTime func(s string) string
+	}
+	st := func(s string) string {
+		timeParsed, err :=  time.Parse(VersionFormat, s)
+		if err != nil {
+			return ""
+		}
+		return timeParsed.String()
+	}
+	tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/compare.html", "templates/diff.html"))
+	tmpl.Execute(w, Context{projects, projectName, *snapshot, true, changes, st})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+
+// Past this many differing lines two versions are taken as unrelated, which keeps
+// the time for matching lines bounded. The memory is linear in any case.
+const maxLineEdits = 5000
+
+const (
+	conflictStartMarker = "<<<<<<< "
+	conflictMidMarker = "======="
+	conflictEndMarker = ">>>>>>> "
+)
+
+
+// isTextFile reports if contents can be merged line by line.
+func isTextFile(raw []byte) bool {
+	return utf8.Valid(raw) && bytes.IndexByte(raw, 0) == -1
+}
+
+
+// splitLines splits text into lines, each keeping its line ending.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines) - 1] == "" {
+		lines = lines[: len(lines) - 1]
+	}
+	return lines
+}
+
+
+// lineMatches returns, for each line of a, the index of the line of b it is paired
+// with in a longest common subsequence of the two, or -1. It is Myers' diff in
+// its linear space form, splitting at the middle snake of the edit script.
+func lineMatches(a, b []string) []int {
+	matches := make([]int, len(a))
+	for i := range matches {
+		matches[i] = -1
+	}
+
+	// lines are compared as numbers.
+	ids := make(map[string]int)
+	toIDs := func(lines []string) []int {
+		lineIDs := make([]int, len(lines))
+		for i, line := range lines {
+			id, ok := ids[line]
+			if ! ok {
+				id = len(ids)
+				ids[line] = id
+			}
+			lineIDs[i] = id
+		}
+		return lineIDs
+	}
+	matchRange(toIDs(a), toIDs(b), 0, 0, matches)
+	return matches
+}
+
+
+// matchRange pairs the lines of a and b into matches. aStart and bStart are where
+// a and b start in the whole versions.
+func matchRange(a, b []int, aStart, bStart int, matches []int) {
+	// the common start and end need no search.
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		matches[aStart] = bStart
+		a, b = a[1 :], b[1 :]
+		aStart, bStart = aStart + 1, bStart + 1
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a) - 1] == b[len(b) - 1] {
+		matches[aStart + len(a) - 1] = bStart + len(b) - 1
+		a, b = a[: len(a) - 1], b[: len(b) - 1]
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return
+	}
+
+	x, y, ok := middleSnake(a, b)
+	if ! ok {
+		return
+	}
+	matchRange(a[: x], b[: y], aStart, bStart, matches)
+	matchRange(a[x :], b[y :], aStart + x, bStart + y, matches)
+}
+
+
+// middleSnake searches for the shortest edit script of a and b from both ends at
+// once and returns the point where the two searches meet, which splits the script
+// in two. It gives up past maxLineEdits edits.
+func middleSnake(a, b []int) (int, int, bool) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	if maxD > maxLineEdits / 2 + 1 {
+		maxD = maxLineEdits / 2 + 1
+	}
+	offset := maxD
+	// forward[k] is the furthest x reached on diagonal k from the start and
+	// backward[k] the furthest reached from the end, counted from the end.
+	forward := make([]int, 2 * maxD + 2)
+	backward := make([]int, 2 * maxD + 2)
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
+	}
+	forward[offset + 1], backward[offset + 1] = 0, 0
+	delta := n - m
+	// with an odd delta the forward search is the one to find the meeting point.
+	forwardMeets := delta % 2 != 0
+	// diagonals that ran off the edges are not searched again.
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+
+	for d := 0; d < maxD; d++ {
+		for k := -d + fStart; k <= d - fEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset + k - 1] < forward[offset + k + 1]) {
+				x = forward[offset + k + 1]
+			} else {
+				x = forward[offset + k - 1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x + 1, y + 1
+			}
+			forward[offset + k] = x
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case forwardMeets:
+				bk := offset + delta - k
+				if bk >= 0 && bk < len(backward) && backward[bk] != -1 && x >= n - backward[bk] {
+					return x, y, true
+				}
+			}
+		}
+
+		for k := -d + bStart; k <= d - bEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && backward[offset + k - 1] < backward[offset + k + 1]) {
+				x = backward[offset + k + 1]
+			} else {
+				x = backward[offset + k - 1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n - x - 1] == b[m - y - 1] {
+				x, y = x + 1, y + 1
+			}
+			backward[offset + k] = x
+			switch {
+			case x > n:
+				bEnd += 2
+			case y > m:
+				bStart += 2
+			case ! forwardMeets:
+				fk := offset + delta - k
+				if fk >= 0 && fk < len(forward) && forward[fk] != -1 {
+					fx := forward[fk]
+					fy := fx - (fk - offset)
+					if fx >= n - x {
+						return fx, fy, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+
+// writeConflict adds a conflict with the standard markers to merged.
+func writeConflict(merged []string, yours, other []string, otherLabel string) []string {
+	withEnding := func(lines []string) []string {
+		if len(lines) > 0 && ! strings.HasSuffix(lines[len(lines) - 1], "\n") {
+			lines = append(append([]string{}, lines[: len(lines) - 1]...), lines[len(lines) - 1] + "\n")
+		}
+		return lines
+	}
+	merged = append(merged, conflictStartMarker + "yours\n")
+	merged = append(merged, withEnding(yours)...)
+	merged = append(merged, conflictMidMarker + "\n")
+	merged = append(merged, withEnding(other)...)
+	return append(merged, conflictEndMarker + otherLabel + "\n")
+}
+
+
+// mergeLines is a three way merge of the lines of yours and other, base being
+// their common ancestor. Runs of lines that only one side changed take that side's
+// change; runs both changed differently become conflicts between markers. It
+// returns the merged lines and the number of conflicts.
+func mergeLines(base, yours, other []string, otherLabel string) ([]string, int) {
+	yoursMatches := lineMatches(base, yours)
+	otherMatches := lineMatches(base, other)
+
+	merged := make([]string, 0, len(yours))
+	conflicts := 0
+	b, y, o := 0, 0, 0
+	for b < len(base) || y < len(yours) || o < len(other) {
+		// lines all three have at the same place are kept.
+		if b < len(base) && yoursMatches[b] == y && otherMatches[b] == o {
+			merged = append(merged, base[b])
+			b, y, o = b + 1, y + 1, o + 1
+			continue
+		}
+
+		// the changed run ends at the next base line both sides still have.
+		nextB := b
+		for nextB < len(base) && (yoursMatches[nextB] == -1 || otherMatches[nextB] == -1) {
+			nextB += 1
+		}
+		nextY, nextO := len(yours), len(other)
+		if nextB < len(base) {
+			nextY, nextO = yoursMatches[nextB], otherMatches[nextB]
+		}
+		baseRun, yoursRun, otherRun := base[b : nextB], yours[y : nextY], other[o : nextO]
+
+		switch {
+		case equalLines(yoursRun, baseRun):
+			merged = append(merged, otherRun...)
+		case equalLines(otherRun, baseRun), equalLines(yoursRun, otherRun):
+			merged = append(merged, yoursRun...)
+		default:
+			// lines both sides agree on at the ends of the run stay outside the markers.
+			head := 0
+			for head < len(yoursRun) && head < len(otherRun) && yoursRun[head] == otherRun[head] {
+				head += 1
+			}
+			tail := 0
+			for tail < len(yoursRun) - head && tail < len(otherRun) - head &&
+				yoursRun[len(yoursRun) - 1 - tail] == otherRun[len(otherRun) - 1 - tail] {
+				tail += 1
+			}
+			merged = append(merged, yoursRun[: head]...)
+			merged = writeConflict(merged, yoursRun[head : len(yoursRun) - tail], otherRun[head : len(otherRun) - tail], otherLabel)
+			merged = append(merged, yoursRun[len(yoursRun) - tail :]...)
+			conflicts += 1
+		}
+		b, y, o = nextB, nextY, nextO
+	}
+	return merged, conflicts
+}
+
+
+// mergeText merges text files with mergeLines.
+func mergeText(base, yours, other []byte, otherLabel string) ([]byte, int) {
+	merged, conflicts := mergeLines(splitLines(string(base)), splitLines(string(yours)),
+		splitLines(string(other)), otherLabel)
+	return []byte(strings.Join(merged, "")), conflicts
+}
+
+
+// countConflictMarkers returns the number of conflicts still marked in a file.
+func countConflictMarkers(raw []byte) int {
+	count := 0
+	for _, line := range splitLines(string(raw)) {
+		if strings.HasPrefix(line, conflictStartMarker) {
+			count += 1
+		}
+	}
+	return count
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+
+// lcsLength is the length of a longest common subsequence of a and b, found the
+// slow way to check lineMatches against.
+func lcsLength(a, b []string) int {
+	lengths := make([][]int, len(a) + 1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b) + 1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lengths[i][j] = lengths[i + 1][j + 1] + 1
+			case lengths[i + 1][j] > lengths[i][j + 1]:
+				lengths[i][j] = lengths[i + 1][j]
+			default:
+				lengths[i][j] = lengths[i][j + 1]
+			}
+		}
+	}
+	return lengths[0][0]
+}
+
+
+func TestLineMatches(t *testing.T) {
+	cases := []struct {
+		name string
+		a string
+		b string
+	}{
+		{"both empty", "", ""},
+		{"all added", "", "a\nb\n"},
+		{"all deleted", "a\nb\n", ""},
+		{"identical", "a\nb\nc\n", "a\nb\nc\n"},
+		{"insert at start", "a\nb\n", "x\na\nb\n"},
+		{"insert at end", "a\nb\n", "a\nb\nx\n"},
+		{"change in the middle", "a\nb\nc\n", "a\nB\nc\n"},
+		{"missing final newline", "a\nb", "a\nb\n"},
+		{"repeated lines", "a\nb\na\nb\na\n", "b\na\nb\na\nb\n"},
+		{"moved block", "a\nb\nc\nd\ne\n", "d\ne\na\nb\nc\n"},
+		{"interleaved", "a\nx\nb\ny\nc\n", "x\na\ny\nb\nz\nc\n"},
+	}
+
+	for _, c := range cases {
+		a, b := splitLines(c.a), splitLines(c.b)
+		matches := lineMatches(a, b)
+		if len(matches) != len(a) {
+			t.Errorf("%s: got %d matches for %d lines", c.name, len(matches), len(a))
+			continue
+		}
+		common, last := 0, -1
+		for i, j := range matches {
+			if j == -1 {
+				continue
+			}
+			if j <= last || j >= len(b) || a[i] != b[j] {
+				t.Errorf("%s: line %d is paired with line %d, which does not keep order or differs", c.name, i, j)
+			}
+			last = j
+			common += 1
+		}
+		if want := lcsLength(a, b); common != want {
+			t.Errorf("%s: %d lines paired, want %d", c.name, common, want)
+		}
+	}
+}
+
+
+func TestLineMatchesRandom(t *testing.T) {
+	// small alphabets give many repeated lines, where pairing goes wrong most easily.
+	rng := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rng.Intn(40))
+		for i := range lines {
+			lines[i] = string(rune('a' + rng.Intn(4))) + "\n"
+		}
+		return lines
+	}
+	for n := 0; n < 500; n++ {
+		a, b := randomLines(), randomLines()
+		matches := lineMatches(a, b)
+		common, last := 0, -1
+		for i, j := range matches {
+			if j == -1 {
+				continue
+			}
+			if j <= last || a[i] != b[j] {
+				t.Fatalf("%q and %q: line %d is paired with line %d, which does not keep order or differs", a, b, i, j)
+			}
+			last = j
+			common += 1
+		}
+		if want := lcsLength(a, b); common != want {
+			t.Fatalf("%q and %q: %d lines paired, want %d", a, b, common, want)
+		}
+	}
+}
+
+
+func TestMergeText(t *testing.T) {
+	cases := []struct {
+		name string
+		base string
+		yours string
+		other string
+		want string
+		conflicts int
+	}{
+		{
+			"adjacent edits",
+			"a\nb\nc\nd\n", "a\nB\nc\nd\n", "a\nb\nC\nd\n",
+			"a\n<<<<<<< yours\nB\nc\n=======\nb\nC\n>>>>>>> other\nd\n", 1,
+		},
+		{
+			"edits a line apart",
+			"a\nb\nc\nd\ne\n", "a\nB\nc\nd\ne\n", "a\nb\nc\nD\ne\n",
+			"a\nB\nc\nD\ne\n", 0,
+		},
+		{
+			"missing final newline kept",
+			"a\nb\nc", "A\nb\nc", "a\nb\nc",
+			"A\nb\nc", 0,
+		},
+		{
+			"final newline added on one side",
+			"a\nb", "a\nb\n", "a\nb",
+			"a\nb\n", 0,
+		},
+		{
+			"lines added after a missing final newline",
+			"a", "a\nb", "a\nc",
+			"a\n<<<<<<< yours\nb\n=======\nc\n>>>>>>> other\n", 1,
+		},
+		{
+			"insertions at start and end",
+			"a\nb\n", "x\na\nb\n", "a\nb\ny\n",
+			"x\na\nb\ny\n", 0,
+		},
+		{
+			"different insertions at start",
+			"a\n", "x\na\n", "y\na\n",
+			"<<<<<<< yours\nx\n=======\ny\n>>>>>>> other\na\n", 1,
+		},
+		{
+			"different insertions at end",
+			"a\n", "a\nx\n", "a\ny\n",
+			"a\n<<<<<<< yours\nx\n=======\ny\n>>>>>>> other\n", 1,
+		},
+		{
+			"identical changes",
+			"a\nb\nc\n", "a\nB\nc\nd\n", "a\nB\nc\nd\n",
+			"a\nB\nc\nd\n", 0,
+		},
+		{
+			"identical deletions",
+			"a\nb\nc\n", "a\nc\n", "a\nc\n",
+			"a\nc\n", 0,
+		},
+		{
+			"change next to a deletion",
+			"a\nb\nc\nd\n", "a\nB\nc\nd\n", "a\nb\nd\n",
+			"a\n<<<<<<< yours\nB\nc\n=======\nb\n>>>>>>> other\nd\n", 1,
+		},
+		{
+			"change of a deleted line",
+			"a\nb\nc\n", "a\nB\nc\n", "a\nc\n",
+			"a\n<<<<<<< yours\nB\n=======\n>>>>>>> other\nc\n", 1,
+		},
+		{
+			"change and deletion a line apart",
+			"a\nb\nc\nd\ne\n", "a\nB\nc\nd\ne\n", "a\nb\nc\ne\n",
+			"a\nB\nc\ne\n", 0,
+		},
+		{
+			"common lines kept outside the markers",
+			"a\nb\nc\n", "a\nx\nB\ny\nc\n", "a\nx\nC\ny\nc\n",
+			"a\nx\n<<<<<<< yours\nB\n=======\nC\n>>>>>>> other\ny\nc\n", 1,
+		},
+	}
+
+	for _, c := range cases {
+		merged, conflicts := mergeText([]byte(c.base), []byte(c.yours), []byte(c.other), "other")
+		if string(merged) != c.want || conflicts != c.conflicts {
+			t.Errorf("%s: got %d conflicts and\n%s\nwant %d conflicts and\n%s", c.name, conflicts,
+				strings.TrimSuffix(string(merged), "\n"), c.conflicts, strings.TrimSuffix(c.want, "\n"))
+		}
+		if got := countConflictMarkers(merged); got != conflicts {
+			t.Errorf("%s: %d conflicts reported but %d marked", c.name, conflicts, got)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"strings"
+)
+
+
+// Diffs are shown with this many unchanged lines around each change.
+const diffContextLines = 3
+
+// FileDiff is a diff of two versions of a text file, ready for the diff template
+// in templates/diff.html, which shows it unified or side by side.
+type FileDiff struct {
+	Hunks []DiffHunk
+}
+
+type DiffHunk struct {
+	Header string
+	Lines []DiffLine
+	// Rows pair the lines for the side by side view.
+	Rows []DiffRow
+}
+
+type DiffLine struct {
+	// Kind is "context", "added" or "deleted".
+	Kind string
+	// OldNum and NewNum are line numbers starting from 1, 0 when the line is not on that side.
+	OldNum int
+	NewNum int
+	Spans []DiffSpan
+}
+
+type DiffRow struct {
+	Left *DiffLine
+	Right *DiffLine
+}
+
+// DiffSpan is a piece of a line with the same coloring. Class holds the syntax
+// class and diff_word for words that changed within the line.
+type DiffSpan struct {
+	Text string
+	Class string
+}
+
+
+// displayLines splits text into lines without their line endings.
+func displayLines(text string) []string {
+	lines := splitLines(text)
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, "\r\n")
+	}
+	return lines
+}
+
+
+// splitWords splits a line into runs of word characters, runs of spaces and
+// single other characters, for finding the words that changed in it.
+func splitWords(line string) []string {
+	words := make([]string, 0)
+	for i := 0; i < len(line); {
+		end := i + 1
+		switch {
+		case isWordByte(line[i]):
+			for end < len(line) && isWordByte(line[end]) {
+				end += 1
+			}
+		case line[i] == ' ' || line[i] == '\t':
+			for end < len(line) && (line[end] == ' ' || line[end] == '\t') {
+				end += 1
+			}
+		}
+		words = append(words, line[i : end])
+		i = end
+	}
+	return words
+}
+
+
+// changedWords marks the bytes of the words of oldLine and newLine that are not
+// common to both. Lines with nothing in common get no marks, as marking all of
+// them says nothing.
+func changedWords(oldLine, newLine string) ([]bool, []bool) {
+	oldWords, newWords := splitWords(oldLine), splitWords(newLine)
+	matches := lineMatches(oldWords, newWords)
+	oldChanged := make([]bool, len(oldLine))
+	newChanged := make([]bool, len(newLine))
+
+	common := false
+	newMatched := make([]bool, len(newWords))
+	for i, j := range matches {
+		if j != -1 {
+			newMatched[j] = true
+			if strings.TrimSpace(oldWords[i]) != "" {
+				common = true
+			}
+		}
+	}
+	if ! common {
+		return oldChanged, newChanged
+	}
+
+	mark := func(words []string, matched func(int) bool, changed []bool) {
+		pos := 0
+		for i, word := range words {
+			if ! matched(i) {
+				for k := pos; k < pos + len(word); k++ {
+					changed[k] = true
+				}
+			}
+			pos += len(word)
+		}
+	}
+	mark(oldWords, func(i int) bool { return matches[i] != -1 }, oldChanged)
+	mark(newWords, func(i int) bool { return newMatched[i] }, newChanged)
+	return oldChanged, newChanged
+}
+
+
+// makeSpans cuts a line into spans where its syntax class or changed mark changes.
+func makeSpans(line string, classes []string, changed []bool) []DiffSpan {
+	spans := make([]DiffSpan, 0)
+	classAt := func(i int) string {
+		class := classes[i]
+		if changed != nil && changed[i] {
+			class = strings.TrimSpace(class + " diff_word")
+		}
+		return class
+	}
+	start := 0
+	for i := 1; i <= len(line); i++ {
+		if i == len(line) || classAt(i) != classAt(start) {
+			spans = append(spans, DiffSpan{line[start : i], classAt(start)})
+			start = i
+		}
+	}
+	return spans
+}
+
+
+// makeFileDiff diffs two versions of a text file. The path picks the syntax
+// coloring.
+func makeFileDiff(path, oldText, newText string) *FileDiff {
+	oldLines, newLines := displayLines(oldText), displayLines(newText)
+	rules := syntaxFor(path)
+	oldClasses, newClasses := highlightLines(rules, oldLines), highlightLines(rules, newLines)
+
+	// every line of both versions in order, as in a unified diff.
+	all := make([]DiffLine, 0, len(oldLines) + len(newLines))
+	matches := lineMatches(splitLines(oldText), splitLines(newText))
+	i, j := 0, 0
+	for i < len(oldLines) || j < len(newLines) {
+		switch {
+		case i < len(oldLines) && matches[i] == j:
+			all = append(all, DiffLine{"context", i + 1, j + 1, makeSpans(newLines[j], newClasses[j], nil)})
+			i, j = i + 1, j + 1
+		case i < len(oldLines) && matches[i] == -1:
+			all = append(all, DiffLine{"deleted", i + 1, 0, makeSpans(oldLines[i], oldClasses[i], nil)})
+			i += 1
+		default:
+			all = append(all, DiffLine{"added", 0, j + 1, makeSpans(newLines[j], newClasses[j], nil)})
+			j += 1
+		}
+	}
+
+	// a deleted line and the added line in its place get their changed words marked.
+	for k := 0; k < len(all); {
+		if all[k].Kind == "context" {
+			k += 1
+			continue
+		}
+		delStart := k
+		for k < len(all) && all[k].Kind == "deleted" {
+			k += 1
+		}
+		addStart := k
+		for k < len(all) && all[k].Kind == "added" {
+			k += 1
+		}
+		for n := 0; delStart + n < addStart && addStart + n < k; n++ {
+			oldLine, newLine := &all[delStart + n], &all[addStart + n]
+			oldChanged, newChanged := changedWords(oldLines[oldLine.OldNum - 1], newLines[newLine.NewNum - 1])
+			oldLine.Spans = makeSpans(oldLines[oldLine.OldNum - 1], oldClasses[oldLine.OldNum - 1], oldChanged)
+			newLine.Spans = makeSpans(newLines[newLine.NewNum - 1], newClasses[newLine.NewNum - 1], newChanged)
+		}
+	}
+
+	// hunks are the changed lines with their context, joined when the context touches.
+	shown := make([]bool, len(all))
+	for k, line := range all {
+		if line.Kind != "context" {
+			for n := k - diffContextLines; n <= k + diffContextLines; n++ {
+				if n >= 0 && n < len(all) {
+					shown[n] = true
+				}
+			}
+		}
+	}
+	fileDiff := &FileDiff{make([]DiffHunk, 0)}
+	for k := 0; k < len(all); {
+		if ! shown[k] {
+			k += 1
+			continue
+		}
+		start := k
+		for k < len(all) && shown[k] {
+			k += 1
+		}
+		fileDiff.Hunks = append(fileDiff.Hunks, makeDiffHunk(all[start : k]))
+	}
+	return fileDiff
+}
+
+
+func makeDiffHunk(lines []DiffLine) DiffHunk {
+	oldStart, newStart, oldCount, newCount := 0, 0, 0, 0
+	for _, line := range lines {
+		if line.OldNum != 0 {
+			if oldStart == 0 {
+				oldStart = line.OldNum
+			}
+			oldCount += 1
+		}
+		if line.NewNum != 0 {
+			if newStart == 0 {
+				newStart = line.NewNum
+			}
+			newCount += 1
+		}
+	}
+	hunk := DiffHunk{
+		Header: fmt.Sprintf("@@ -%d,%d +%d,%d @@", oldStart, oldCount, newStart, newCount),
+		Lines: lines,
+		Rows: make([]DiffRow, 0, len(lines)),
+	}
+
+	for k := 0; k < len(lines); {
+		if lines[k].Kind == "context" {
+			hunk.Rows = append(hunk.Rows, DiffRow{&lines[k], &lines[k]})
+			k += 1
+			continue
+		}
+		deleted := make([]*DiffLine, 0)
+		for k < len(lines) && lines[k].Kind == "deleted" {
+			deleted = append(deleted, &lines[k])
+			k += 1
+		}
+		added := make([]*DiffLine, 0)
+		for k < len(lines) && lines[k].Kind == "added" {
+			added = append(added, &lines[k])
+			k += 1
+		}
+		for n := 0; n < len(deleted) || n < len(added); n++ {
+			var row DiffRow
+			if n < len(deleted) {
+				row.Left = deleted[n]
+			}
+			if n < len(added) {
+				row.Right = added[n]
+			}
+			hunk.Rows = append(hunk.Rows, row)
+		}
+	}
+	return hunk
+}
+
+
+// Images bigger than this are described but not shown, since they are put in the
+// page itself.
+const maxImagePreviewSize = 4 * 1024 * 1024
+
+// BinaryChange describes a changed file that is not text. The Image fields are
+// set when both versions are images that can be shown.
+type BinaryChange struct {
+	OldSize string
+	NewSize string
+	OldHash string
+	NewHash string
+	OldImage template.URL
+	NewImage template.URL
+	OldDimensions string
+	NewDimensions string
+}
+
+
+func formatSize(size int) string {
+	switch {
+	case size >= 1024 * 1024:
+		return fmt.Sprintf("%.1f MB", float64(size) / (1024 * 1024))
+	case size >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(size) / 1024)
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
+
+
+// imagePreview returns raw as a data url and its width and height when it is
+// an image in a format the webview shows.
+func imagePreview(raw []byte) (template.URL, string, bool) {
+	contentType := http.DetectContentType(raw)
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif", "image/webp", "image/bmp":
+	default:
+		return "", "", false
+	}
+	if len(raw) > maxImagePreviewSize {
+		return "", "", false
+	}
+	dimensions := ""
+	if config, _, err := image.DecodeConfig(bytes.NewReader(raw)); err == nil {
+		dimensions = fmt.Sprintf("%d × %d", config.Width, config.Height)
+	}
+	// the data is base64 and the type one of the above, so the url is safe.
+	return template.URL("data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(raw)), dimensions, true
+}
+
+
+func makeBinaryChange(rawOld, rawNew []byte) *BinaryChange {
+	change := &BinaryChange{
+		OldSize: formatSize(len(rawOld)),
+		NewSize: formatSize(len(rawNew)),
+		OldHash: hashBytes(rawOld),
+		NewHash: hashBytes(rawNew),
+	}
+	oldImage, oldDimensions, oldOK := imagePreview(rawOld)
+	newImage, newDimensions, newOK := imagePreview(rawNew)
+	if oldOK && newOK {
+		change.OldImage, change.NewImage = oldImage, newImage
+		change.OldDimensions, change.NewDimensions = oldDimensions, newDimensions
+	}
+	return change
+}
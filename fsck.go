@@ -0,0 +1,187 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+)
+
+
+type FsckReport struct {
+	SnapshotsChecked int
+	BlobsChecked int
+	Problems []string
+	Orphans []string
+}
+
+
+// verifySnapshotArchive reads a whole tar.gz snapshot, confirming it decompresses
+// and matches its hash.
+func verifySnapshotArchive(store Store, objectName, expectedHash string) error {
+	rc, err := store.NewReader(objectName)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	h := sha256.New()
+	gzr, err := gzip.NewReader(io.TeeReader(rc, h))
+	if err != nil {
+		return errors.Wrap(err, "gzip error")
+	}
+	tr := tar.NewReader(gzr)
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "tar error")
+		}
+		_, err = io.Copy(io.Discard, tr)
+		if err != nil {
+			return errors.Wrap(err, "tar error")
+		}
+	}
+	_, err = io.Copy(h, rc)
+	if err != nil {
+		return errors.Wrap(err, "storage error")
+	}
+	if expectedHash != "" && fmt.Sprintf("%x", h.Sum(nil)) != expectedHash {
+		return errors.New("hash mismatch")
+	}
+	return nil
+}
+
+
+// fsckStore walks every member's manifest and confirms each snapshot it refers to
+// is present and not corrupted. Snapshot objects and blobs nothing refers to are
+// reported as orphans.
+func fsckStore(store Store) (FsckReport, error) {
+	report := FsckReport{Problems: make([]string, 0), Orphans: make([]string, 0)}
+
+	allNames, err := store.List("")
+	if err != nil {
+		return report, err
+	}
+	existing := make(map[string]bool)
+	for _, name := range allNames {
+		existing[name] = true
+	}
+
+	members, err := getTeamMembers(store, "")
+	if err != nil {
+		return report, err
+	}
+
+	referenced := make(map[string]bool)
+	checkedBlobs := make(map[string]bool)
+	for _, email := range members {
+		snapshots, err := getManifest(store, email)
+		if err != nil {
+			report.Problems = append(report.Problems, fmt.Sprintf("manifest of %s: %s", email, err))
+			continue
+		}
+
+		for _, snapshotObj := range snapshots {
+			snapshotName := snapshotObj.Name
+			treeName := snapshotTreeName(email, snapshotName)
+			archiveName := snapshotArchiveName(email, snapshotName)
+			report.SnapshotsChecked += 1
+
+			if existing[treeName] {
+				referenced[treeName] = true
+				tree, err := getSnapshotTree(store, email, snapshotName, snapshotObj.Hash)
+				if err != nil {
+					report.Problems = append(report.Problems, fmt.Sprintf("%s: %s", treeName, err))
+					continue
+				}
+				for _, entry := range tree.Files {
+					for _, ref := range entry.blobs() {
+						bn := blobName(store, ref.Hash)
+						if ! existing[bn] && existing[plainBlobName(ref.Hash)] {
+							bn = plainBlobName(ref.Hash)
+						}
+						referenced[bn] = true
+						if checkedBlobs[bn] {
+							continue
+						}
+						checkedBlobs[bn] = true
+						if ! existing[bn] {
+							report.Problems = append(report.Problems, fmt.Sprintf("%s: missing blob for %s", treeName, entry.Path))
+							continue
+						}
+						report.BlobsChecked += 1
+						err = readBlob(store, ref.Hash, ref.Size, io.Discard)
+						if err != nil {
+							report.Problems = append(report.Problems, fmt.Sprintf("%s (%s in %s): %s", bn, entry.Path, treeName, err))
+						}
+					}
+				}
+
+			} else if existing[archiveName] {
+				referenced[archiveName] = true
+				err = verifySnapshotArchive(store, archiveName, snapshotObj.Hash)
+				if err != nil {
+					report.Problems = append(report.Problems, fmt.Sprintf("%s: %s", archiveName, err))
+				}
+
+			} else {
+				report.Problems = append(report.Problems, fmt.Sprintf("snapshot %s of %s is missing", snapshotName, email))
+			}
+		}
+	}
+
+	for _, name := range allNames {
+		isSnapshotObject := strings.HasPrefix(name, "blobs/") || strings.HasSuffix(name, ".tree.json") ||
+			strings.HasSuffix(name, ".tar.gz")
+		if isSnapshotObject && ! referenced[name] {
+			report.Orphans = append(report.Orphans, name)
+		}
+	}
+
+	return report, nil
+}
+
+
+func fsckProject(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectName := vars["proj"]
+
+	pd, err := getProjectData(projectName)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	store, err := getStore(pd)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	projects, err := getAllProjects()
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+
+	report, err := fsckStore(store)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+
+	type Context struct {
+		Projects []string
+		CurrentProject string
+		Report FsckReport
+	}
+	tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/fsck.html"))
+	tmpl.Execute(w, Context{projects, projectName, report})
+}
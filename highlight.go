@@ -0,0 +1,235 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+
+// SyntaxRules is as much of a language as diffs need to color its keywords,
+// strings, comments and numbers.
+type SyntaxRules struct {
+	Keywords map[string]bool
+	LineComments []string
+	// BlockComment holds the start and end of block comments, if the language has them.
+	BlockComment [2]string
+	// Quotes are the characters strings start and end with.
+	Quotes string
+}
+
+// the classes of highlighted source, used as css classes.
+const (
+	syntaxKeyword = "syn_kw"
+	syntaxString = "syn_str"
+	syntaxComment = "syn_com"
+	syntaxNumber = "syn_num"
+)
+
+
+func makeKeywords(words string) map[string]bool {
+	keywords := make(map[string]bool)
+	for _, word := range strings.Fields(words) {
+		keywords[word] = true
+	}
+	return keywords
+}
+
+
+var cLikeKeywords = "if else for while do switch case default break continue return goto struct union enum " +
+	"typedef const static extern void int char short long float double unsigned signed sizeof"
+
+var syntaxByLanguage = map[string]*SyntaxRules{
+	"go": {
+		Keywords: makeKeywords("break case chan const continue default defer else fallthrough for func go goto if " +
+			"import interface map package range return select struct switch type var nil true false iota"),
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes: "\"'`",
+	},
+	"c": {
+		Keywords: makeKeywords(cLikeKeywords + " class namespace template typename public private protected " +
+			"virtual new delete this true false nullptr auto bool"),
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes: "\"'",
+	},
+	"java": {
+		Keywords: makeKeywords("abstract boolean break byte case catch char class const continue default do double " +
+			"else enum extends final finally float for if implements import instanceof int interface long new " +
+			"package private protected public return short static super switch synchronized this throw throws " +
+			"try void volatile while true false null var fun val override object when"),
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes: "\"'",
+	},
+	"js": {
+		Keywords: makeKeywords("break case catch class const continue debugger default delete do else export " +
+			"extends finally for function if import in instanceof let new return super switch this throw try " +
+			"typeof var void while with yield async await of true false null undefined interface type enum"),
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes: "\"'`",
+	},
+	"rust": {
+		Keywords: makeKeywords("as break const continue crate else enum extern false fn for if impl in let loop " +
+			"match mod move mut pub ref return self Self static struct super trait true type unsafe use where while"),
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes: "\"",
+	},
+	"python": {
+		Keywords: makeKeywords("and as assert async await break class continue def del elif else except finally " +
+			"for from global if import in is lambda nonlocal not or pass raise return try while with yield " +
+			"True False None self"),
+		LineComments: []string{"#"},
+		Quotes: "\"'",
+	},
+	"ruby": {
+		Keywords: makeKeywords("alias and begin break case class def do else elsif end ensure false for if in " +
+			"module next nil not or redo rescue retry return self super then true undef unless until when while yield"),
+		LineComments: []string{"#"},
+		Quotes: "\"'",
+	},
+	"shell": {
+		Keywords: makeKeywords("if then else elif fi case esac for while until do done in function return " +
+			"export local echo"),
+		LineComments: []string{"#"},
+		Quotes: "\"'",
+	},
+	"css": {
+		Keywords: makeKeywords("important"),
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes: "\"'",
+	},
+	"sql": {
+		Keywords: makeKeywords("select from where insert into values update set delete create table drop alter " +
+			"index primary key foreign references join left right inner outer on and or not null as order by " +
+			"group having limit SELECT FROM WHERE INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE DROP ALTER " +
+			"INDEX PRIMARY KEY FOREIGN REFERENCES JOIN LEFT RIGHT INNER OUTER ON AND OR NOT NULL AS ORDER BY " +
+			"GROUP HAVING LIMIT"),
+		LineComments: []string{"--"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes: "'\"",
+	},
+	"json": {
+		Keywords: makeKeywords("true false null"),
+		Quotes: "\"",
+	},
+}
+
+var languageByExtension = map[string]string{
+	".go": "go",
+	".c": "c", ".h": "c", ".cc": "c", ".cpp": "c", ".hpp": "c", ".cs": "java",
+	".java": "java", ".kt": "java", ".scala": "java", ".swift": "java", ".dart": "java",
+	".js": "js", ".jsx": "js", ".ts": "js", ".tsx": "js", ".mjs": "js",
+	".rs": "rust",
+	".py": "python",
+	".rb": "ruby",
+	".sh": "shell", ".bash": "shell",
+	".css": "css", ".scss": "css",
+	".sql": "sql",
+	".json": "json",
+}
+
+
+// syntaxFor returns the rules for coloring a file by its extension, or nil.
+func syntaxFor(path string) *SyntaxRules {
+	return syntaxByLanguage[languageByExtension[strings.ToLower(filepath.Ext(path))]]
+}
+
+
+func isWordByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
+
+
+// highlightLines returns the syntax class of each byte of each line. Block comments
+// and strings that span lines are followed from line to line.
+func highlightLines(rules *SyntaxRules, lines []string) [][]string {
+	classes := make([][]string, len(lines))
+	if rules == nil {
+		for i, line := range lines {
+			classes[i] = make([]string, len(line))
+		}
+		return classes
+	}
+
+	inBlock := false
+	var inString byte
+	for n, line := range lines {
+		lineClasses := make([]string, len(line))
+		i := 0
+		mark := func(end int, class string) {
+			for ; i < end; i++ {
+				lineClasses[i] = class
+			}
+		}
+		for i < len(line) {
+			switch {
+			case inBlock:
+				end := strings.Index(line[i :], rules.BlockComment[1])
+				if end == -1 {
+					mark(len(line), syntaxComment)
+				} else {
+					mark(i + end + len(rules.BlockComment[1]), syntaxComment)
+					inBlock = false
+				}
+			case inString != 0:
+				end := i
+				for end < len(line) && line[end] != inString {
+					if line[end] == '\\' {
+						end += 1
+					}
+					end += 1
+				}
+				if end < len(line) {
+					end += 1
+					inString = 0
+				} else {
+					end = len(line)
+					// only backquoted strings go on past the line.
+					if inString != '`' {
+						inString = 0
+					}
+				}
+				mark(end, syntaxString)
+			case rules.BlockComment[0] != "" && strings.HasPrefix(line[i :], rules.BlockComment[0]):
+				mark(i + len(rules.BlockComment[0]), syntaxComment)
+				inBlock = true
+			case hasAnyPrefix(line[i :], rules.LineComments):
+				mark(len(line), syntaxComment)
+			case strings.IndexByte(rules.Quotes, line[i]) != -1:
+				inString = line[i]
+				mark(i + 1, syntaxString)
+			case isWordByte(line[i]):
+				end := i
+				for end < len(line) && isWordByte(line[end]) {
+					end += 1
+				}
+				word := line[i : end]
+				switch {
+				case rules.Keywords[word]:
+					mark(end, syntaxKeyword)
+				case word[0] >= '0' && word[0] <= '9':
+					mark(end, syntaxNumber)
+				default:
+					mark(end, "")
+				}
+			default:
+				i += 1
+			}
+		}
+		classes[n] = lineClasses
+	}
+	return classes
+}
+
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"net/http"
+	"os"
+)
+
+
+// HistoryGraph is the snapshots of all the members of a project linked by their
+// parents. The first parent of a snapshot is the one before it in its author's
+// manifest. Merges have the merged snapshot of the other member as a second
+// parent and a start from has the snapshot started from.
+type HistoryGraph struct {
+	Snapshots map[SnapshotRef]Snapshot
+}
+
+
+func getHistoryGraph(store Store) (HistoryGraph, error) {
+	graph := HistoryGraph{make(map[SnapshotRef]Snapshot)}
+	members, err := getTeamMembers(store, "")
+	if err != nil {
+		return graph, err
+	}
+	for _, email := range members {
+		snapshots, err := getManifest(store, email)
+		if err != nil {
+			return graph, err
+		}
+		for _, snapshot := range snapshots {
+			graph.Snapshots[SnapshotRef{email, snapshot.Name}] = snapshot
+		}
+	}
+	return graph, nil
+}
+
+
+// ancestors returns ref and every snapshot it was built on. Parents removed by
+// cleaning snapshots end the walk.
+func (g HistoryGraph) ancestors(ref SnapshotRef) map[SnapshotRef]bool {
+	seen := map[SnapshotRef]bool{ref: true}
+	toVisit := []SnapshotRef{ref}
+	for len(toVisit) > 0 {
+		current := toVisit[len(toVisit) - 1]
+		toVisit = toVisit[: len(toVisit) - 1]
+		for _, parent := range g.Snapshots[current].Parents {
+			if ! seen[parent] {
+				seen[parent] = true
+				toVisit = append(toVisit, parent)
+			}
+		}
+	}
+	return seen
+}
+
+
+// isAncestor reports if the work of ancestor is in ref.
+func (g HistoryGraph) isAncestor(ancestor, ref SnapshotRef) bool {
+	return g.ancestors(ref)[ancestor]
+}
+
+
+// historyGraphJSON serves a project's history graph as a list of nodes with
+// their parents, for tools built on Floraad. Errors are served as JSON too, with
+// a 4xx or 5xx status.
+func historyGraphJSON(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectName := vars["proj"]
+
+	pd, err := getProjectData(projectName)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, os.ErrNotExist) {
+			status = http.StatusNotFound
+		}
+		jsonError(w, status, err)
+		return
+	}
+	store, err := getStore(pd)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	graph, err := getHistoryGraph(store)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if isOfflineError(err) {
+			status = http.StatusServiceUnavailable
+		}
+		jsonError(w, status, err)
+		return
+	}
+
+	type Node struct {
+		SnapshotRef
+		Desc string `json:"desc"`
+		Parents []SnapshotRef `json:"parents"`
+		Origin *SnapshotOrigin `json:"origin,omitempty"`
+	}
+	nodes := make([]Node, 0, len(graph.Snapshots))
+	for ref, snapshot := range graph.Snapshots {
+		parents := snapshot.Parents
+		if parents == nil {
+			parents = make([]SnapshotRef, 0)
+		}
+		nodes = append(nodes, Node{ref, snapshot.Desc, parents, snapshot.Origin})
+	}
+
+	jsonBytes, err := json.Marshal(map[string]interface{} {"nodes": nodes})
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, errors.Wrap(err, "json error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
+
+
+// mergeBase returns the best common ancestor of two snapshots: one that is not an
+// ancestor of another common ancestor, the newest if there are several.
+func (g HistoryGraph) mergeBase(a, b SnapshotRef) (SnapshotRef, bool) {
+	aAncestors := g.ancestors(a)
+	common := make([]SnapshotRef, 0)
+	for ref := range g.ancestors(b) {
+		if _, ok := g.Snapshots[ref]; ok && aAncestors[ref] {
+			common = append(common, ref)
+		}
+	}
+
+	// a common ancestor of another common ancestor is older news.
+	notBest := make(map[SnapshotRef]bool)
+	for _, candidate := range common {
+		for ref := range g.ancestors(candidate) {
+			if ref != candidate {
+				notBest[ref] = true
+			}
+		}
+	}
+
+	var base SnapshotRef
+	found := false
+	for _, candidate := range common {
+		if ! notBest[candidate] && (! found || snapshotTimeBefore(base.Name, candidate.Name)) {
+			base = candidate
+			found = true
+		}
+	}
+	return base, found
+}
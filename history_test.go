@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+
+// testHistoryGraph builds a graph from a map of snapshots to their parents.
+func testHistoryGraph(parents map[SnapshotRef][]SnapshotRef) HistoryGraph {
+	graph := HistoryGraph{make(map[SnapshotRef]Snapshot)}
+	for ref, refParents := range parents {
+		graph.Snapshots[ref] = Snapshot{Name: ref.Name, AuthorEmail: ref.Email, Parents: refParents}
+	}
+	return graph
+}
+
+
+func TestMergeBase(t *testing.T) {
+	a1 := SnapshotRef{"a@example.com", "20220101T100000UTC"}
+	a2 := SnapshotRef{"a@example.com", "20220102T100000UTC"}
+	a3 := SnapshotRef{"a@example.com", "20220104T100000UTC"}
+	a4 := SnapshotRef{"a@example.com", "20220106T100000UTC"}
+	b1 := SnapshotRef{"b@example.com", "20220103T100000UTC"}
+	b2 := SnapshotRef{"b@example.com", "20220105T100000UTC"}
+	b3 := SnapshotRef{"b@example.com", "20220107T100000UTC"}
+	c1 := SnapshotRef{"c@example.com", "20220101T090000UTC"}
+	cleaned := SnapshotRef{"a@example.com", "20211231T100000UTC"}
+
+	cases := []struct {
+		name string
+		graph map[SnapshotRef][]SnapshotRef
+		a, b SnapshotRef
+		want SnapshotRef
+		found bool
+	}{
+		{
+			"older snapshot of the same member",
+			map[SnapshotRef][]SnapshotRef{a1: nil, a2: {a1}, a3: {a2}},
+			a3, a1, a1, true,
+		},
+		{
+			"same snapshot",
+			map[SnapshotRef][]SnapshotRef{a1: nil, a2: {a1}},
+			a2, a2, a2, true,
+		},
+		{
+			"start from",
+			map[SnapshotRef][]SnapshotRef{a1: nil, a2: {a1}, b1: {a1}},
+			a2, b1, a1, true,
+		},
+		{
+			"after a merge",
+			map[SnapshotRef][]SnapshotRef{a1: nil, a2: {a1}, b1: {a1}, a3: {a2, b1}, b2: {b1}},
+			a3, b2, b1, true,
+		},
+		{
+			"after merges both ways",
+			map[SnapshotRef][]SnapshotRef{a1: nil, a2: {a1}, b1: {a1}, a3: {a2, b1}, b2: {b1, a3}, a4: {a3}},
+			a4, b2, a3, true,
+		},
+		{
+			// a3 and b2 each merged the other's older snapshot, so b1 and a2 are both
+			// best and the newer is taken.
+			"criss cross",
+			map[SnapshotRef][]SnapshotRef{a1: nil, a2: {a1}, b1: {a1}, a3: {a2, b1}, b2: {b1, a2}, a4: {a3}, b3: {b2}},
+			a4, b3, b1, true,
+		},
+		{
+			"unrelated",
+			map[SnapshotRef][]SnapshotRef{a1: nil, a2: {a1}, c1: nil},
+			a2, c1, SnapshotRef{}, false,
+		},
+		{
+			"common ancestor cleaned",
+			map[SnapshotRef][]SnapshotRef{a1: {cleaned}, b1: {cleaned}},
+			a1, b1, SnapshotRef{}, false,
+		},
+	}
+
+	for _, c := range cases {
+		graph := testHistoryGraph(c.graph)
+		for _, order := range [][2]SnapshotRef{{c.a, c.b}, {c.b, c.a}} {
+			got, found := graph.mergeBase(order[0], order[1])
+			if got != c.want || found != c.found {
+				t.Errorf("%s: merge base of %v and %v is %v (%v), want %v (%v)", c.name, order[0], order[1],
+					got, found, c.want, c.found)
+			}
+		}
+	}
+}
+
+
+func TestHistoryGraphJSONErrors(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SNAP_USER_COMMON", "")
+
+	r := httptest.NewRequest(http.MethodGet, "/history/missing", nil)
+	r = mux.SetURLVars(r, map[string]string{"proj": "missing"})
+	w := httptest.NewRecorder()
+	historyGraphJSON(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d for a missing project, want %d", w.Code, http.StatusNotFound)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("got content type %q", contentType)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] == "" {
+		t.Errorf("got body %q, want a JSON error", w.Body.String())
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"encoding/json"
 	"github.com/pkg/errors"
 	"strings"
+	"time"
 )
 
 var wv webview.WebView
@@ -24,6 +25,7 @@ func init() {
 	os.MkdirAll(filepath.Join(rootPath, "p"), 0777)
 	os.MkdirAll(filepath.Join(rootPath, "flotmp"), 0777)	
 	os.MkdirAll(filepath.Join(rootPath, "pd"), 0777)	
+	os.MkdirAll(filepath.Join(rootPath, "outbox"), 0777)
 }
 
 
@@ -40,6 +42,7 @@ func main() {
 
 	defer func() {
 		emptyDir(filepath.Join(rootPath, "flotmp"))
+		closeStoreClients()
 	}()
 
 
@@ -71,9 +74,9 @@ func main() {
 
 
 	  r.HandleFunc("/save_user_data", func(w http.ResponseWriter, r *http.Request) {
-	  	userData := map[string]string {
-	  		"fullname": r.FormValue("fullname"),
-	  		"email": r.FormValue("email"),
+	  	userData := UserProfile{
+	  		Email: r.FormValue("email"),
+	  		FullName: r.FormValue("fullname"),
 	  	}
 
 	  	jsonBytes, err := json.Marshal(userData)
@@ -103,6 +106,8 @@ func main() {
 			w.Write(rawObj)
 		})
 
+		r.HandleFunc("/settings", updateSettings)
+
 		r.HandleFunc("/xdg/", func (w http.ResponseWriter, r *http.Request) {
 			exec.Command("xdg-open", r.FormValue("p")).Run()
 		})
@@ -115,6 +120,7 @@ func main() {
 		r.HandleFunc("/update_exrules/{proj}", updateExclusionRules)
 		r.HandleFunc("/join_project", joinProject)
 		r.HandleFunc("/end_join_project", endJoinProject)
+		r.HandleFunc("/fsck/{proj}", fsckProject)
 
 
 		// snapshots
@@ -130,11 +136,22 @@ func main() {
 		r.HandleFunc("/view_others_snapshots/{proj}/{email}", viewOthersSnapshots)
 		r.HandleFunc("/view_others_snapshot/{proj}/{email}/{sname}", viewOthersSnapshot)
 		r.HandleFunc("/start_from_this/{proj}/{email}/{sname}", startFromThis)
+		r.HandleFunc("/history/{proj}", historyGraphJSON)
+
+		r.HandleFunc("/compare/{proj}/{emailA}/{snapA}/{emailB}/{snapB}", compareSnapshots)
+		r.HandleFunc("/compare_working_tree/{proj}/{email}/{sname}", compareWithWorkingTree)
 
 		// merges
 		r.HandleFunc("/start_merge/{proj}/{email}", startMerge)
+		r.HandleFunc("/start_merge/{proj}/{email}/{sname}", startMerge)
 		r.HandleFunc("/cancel_merge/{proj}", cancelMerge)
 		r.HandleFunc("/complete_merge/{proj}", completeMerge)
+		r.HandleFunc("/merge/{proj}", viewMerge)
+		r.HandleFunc("/merge_file/{proj}", viewMergeFile)
+		r.HandleFunc("/resolve_conflict/{proj}", resolveConflict)
+		r.HandleFunc("/stashes/{proj}", viewStashes)
+		r.HandleFunc("/apply_stash/{proj}/{name}", applyStash)
+		r.HandleFunc("/drop_stash/{proj}/{name}", dropStash)
 
 
 	  err := http.ListenAndServe(fmt.Sprintf(":%s", port), r)
@@ -144,6 +161,14 @@ func main() {
 
 	}()
 
+	// upload snapshots queued while offline once the storage is back.
+	go func() {
+		for {
+			syncAllOutboxes()
+			time.Sleep(3 * time.Minute)
+		}
+	}()
+
 	w := webview.New(debug)
 	wv = w
 	defer w.Destroy()
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+
+// A member's snapshots are listed newest first in <email>/manifest.json. The
+// first manifests were a bare list of string maps; they are read as version 1
+// and saved in the current form the next time the manifest changes.
+const ManifestVersion = 2
+
+type Manifest struct {
+	Version int `json:"version"`
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+
+// SnapshotRef names a snapshot of any member.
+type SnapshotRef struct {
+	Email string `json:"email"`
+	Name string `json:"name"`
+}
+
+
+// SnapshotOrigin says which snapshot a revert, a start from or a merge came from.
+type SnapshotOrigin struct {
+	// Action is one of the Origin constants.
+	Action string `json:"action"`
+	From SnapshotRef `json:"from"`
+}
+
+const (
+	OriginRevert = "revert"
+	OriginStartFrom = "start_from"
+	OriginMerge = "merge"
+)
+
+
+type Snapshot struct {
+	Name string `json:"name"`
+	Desc string `json:"desc"`
+	AuthorEmail string `json:"author_email"`
+	AuthorName string `json:"author_name,omitempty"`
+	// Parents are the snapshots this one was made on top of: the previous
+	// snapshot in the author's manifest, then for a merge the merged snapshot and
+	// for a start from the snapshot started from. See HistoryGraph.
+	Parents []SnapshotRef `json:"parents,omitempty"`
+	Origin *SnapshotOrigin `json:"origin,omitempty"`
+	// FileCount is unknown (0) for snapshots from version 1 manifests.
+	FileCount int `json:"file_count"`
+	// Hash and Size are those of the tree object, or of the archive of older snapshots.
+	Hash string `json:"hash,omitempty"`
+	Size int64 `json:"size,omitempty"`
+}
+
+
+// newSnapshot returns the manifest entry of a snapshot the user is making now.
+func newSnapshot(userData UserProfile, desc string) Snapshot {
+	return Snapshot{
+		Name: time.Now().Format(VersionFormat),
+		Desc: desc,
+		AuthorEmail: userData.Email,
+		AuthorName: userData.FullName,
+	}
+}
+
+
+// OriginText describes the origin of a snapshot for the snapshot lists.
+func (s Snapshot) OriginText() string {
+	if s.Origin == nil {
+		return ""
+	}
+	from := s.Origin.From.Name
+	if t, err := time.Parse(VersionFormat, from); err == nil {
+		from = t.String()
+	}
+	switch s.Origin.Action {
+	case OriginRevert:
+		return "Reverted to the snapshot of " + from
+	case OriginStartFrom:
+		return "Started from the snapshot of " + s.Origin.From.Email + " of " + from
+	case OriginMerge:
+		return "Merged with the snapshot of " + s.Origin.From.Email + " of " + from
+	}
+	return ""
+}
+
+
+// snapshotsFromV1 converts the entries of a version 1 manifest. Entries are newest
+// first, so the parent of each is the entry after it.
+func snapshotsFromV1(email string, entries []map[string]string) []Snapshot {
+	snapshots := make([]Snapshot, 0, len(entries))
+	for i, entry := range entries {
+		snapshot := Snapshot{
+			Name: entry["snapshot_name"],
+			Desc: entry["snapshot_desc"],
+			AuthorEmail: email,
+			Hash: entry["snapshot_hash"],
+		}
+		snapshot.Size, _ = strconv.ParseInt(entry["snapshot_size"], 10, 64)
+		if i + 1 < len(entries) {
+			snapshot.Parents = []SnapshotRef{{email, entries[i + 1]["snapshot_name"]}}
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots
+}
+
+
+// parseManifest reads a manifest of any version.
+func parseManifest(email string, raw []byte) ([]Snapshot, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		entries := make([]map[string]string, 0)
+		err := json.Unmarshal(raw, &entries)
+		if err != nil {
+			return nil, errors.Wrap(err, "json error")
+		}
+		return snapshotsFromV1(email, entries), nil
+	}
+
+	var manifest Manifest
+	err := json.Unmarshal(raw, &manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "json error")
+	}
+	if manifest.Version > ManifestVersion {
+		return nil, errors.New(fmt.Sprintf("The snapshots of %s were saved by a newer version of Floraad. "+
+			"Please update Floraad.", email))
+	}
+	if manifest.Snapshots == nil {
+		manifest.Snapshots = make([]Snapshot, 0)
+	}
+	return manifest.Snapshots, nil
+}
+
+
+// getManifest returns the snapshots of a member, newest first. A member who
+// has not made any snapshot has an empty manifest.
+func getManifest(store Store, email string) ([]Snapshot, error) {
+	manifestStatus, err := store.Exists(email + "/manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	if ! manifestStatus {
+		return make([]Snapshot, 0), nil
+	}
+
+	manifestRaw, err := store.Get(email + "/manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(email, manifestRaw)
+}
+
+
+// findSnapshot returns the manifest entry of a snapshot or nil.
+func findSnapshot(snapshots []Snapshot, snapshotName string) *Snapshot {
+	for i := range snapshots {
+		if snapshots[i].Name == snapshotName {
+			return &snapshots[i]
+		}
+	}
+	return nil
+}
+
+
+// updateManifest applies edit to a member's manifest and saves the result only if
+// nobody saved the manifest in between. When someone did, the edit is applied
+// again to the newer manifest, so edit may be called more than once.
+func updateManifest(store Store, email string, edit func(snapshots []Snapshot) ([]Snapshot, error)) error {
+	for i := 0; i < 5; i++ {
+		manifestRaw, version, err := store.GetWithVersion(email + "/manifest.json")
+		if err != nil {
+			return err
+		}
+		snapshots := make([]Snapshot, 0)
+		if version != "" {
+			snapshots, err = parseManifest(email, manifestRaw)
+			if err != nil {
+				return err
+			}
+		}
+
+		newSnapshots, err := edit(snapshots)
+		if err != nil {
+			return err
+		}
+		jsonBytes, err := json.Marshal(Manifest{ManifestVersion, newSnapshots})
+		if err != nil {
+			return errors.Wrap(err, "json error")
+		}
+
+		err = store.PutIfVersion(email + "/manifest.json", jsonBytes, version)
+		if err == ErrVersionMismatch {
+			continue
+		}
+		return err
+	}
+
+	return errors.New("Your snapshots list is being changed from another place at the same time. " +
+		"Nothing was saved to it. Please try again.")
+}
+
+
+// addSnapshotEntry returns an edit for updateManifest that puts a new snapshot at
+// the top of the manifest, with the snapshot that was there as its first parent.
+func addSnapshotEntry(snapshot Snapshot) func([]Snapshot) ([]Snapshot, error) {
+	return func(snapshots []Snapshot) ([]Snapshot, error) {
+		existing := findSnapshot(snapshots, snapshot.Name)
+		if existing != nil && existing.Hash != "" && existing.Hash == snapshot.Hash {
+			// an earlier attempt was saved though its reply got lost.
+			return snapshots, nil
+		}
+		if existing != nil {
+			return nil, errors.New("A snapshot named " + snapshot.Name + " already exists. " +
+				"It was probably saved by a second submit of the same form.")
+		}
+		if len(snapshots) > 0 {
+			snapshot.Parents = append([]SnapshotRef{{snapshot.AuthorEmail, snapshots[0].Name}}, snapshot.Parents...)
+		}
+		return append([]Snapshot{snapshot}, snapshots...), nil
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+
+func TestParseManifest(t *testing.T) {
+	email := "a@example.com"
+	cases := []struct {
+		name string
+		raw string
+		want []Snapshot
+		fails bool
+	}{
+		{"empty version 1", "[]", []Snapshot{}, false},
+		{
+			"version 1",
+			` [{"snapshot_name": "20220102T100000UTC", "snapshot_desc": "second", "snapshot_hash": "h2", "snapshot_size": "20"},
+				{"snapshot_name": "20220101T100000UTC", "snapshot_desc": "first", "snapshot_hash": "h1", "snapshot_size": "10"}]`,
+			[]Snapshot{
+				{Name: "20220102T100000UTC", Desc: "second", AuthorEmail: email, Hash: "h2", Size: 20,
+					Parents: []SnapshotRef{{email, "20220101T100000UTC"}}},
+				{Name: "20220101T100000UTC", Desc: "first", AuthorEmail: email, Hash: "h1", Size: 10},
+			},
+			false,
+		},
+		{
+			"version 1 without a size",
+			`[{"snapshot_name": "20220101T100000UTC", "snapshot_desc": "first"}]`,
+			[]Snapshot{{Name: "20220101T100000UTC", Desc: "first", AuthorEmail: email}},
+			false,
+		},
+		{
+			"version 2",
+			`{"version": 2, "snapshots": [{"name": "20220102T100000UTC", "desc": "merged", "author_email": "a@example.com",
+				"parents": [{"email": "a@example.com", "name": "20220101T100000UTC"}, {"email": "b@example.com", "name": "20211231T100000UTC"}],
+				"origin": {"action": "merge", "from": {"email": "b@example.com", "name": "20211231T100000UTC"}}, "file_count": 3}]}`,
+			[]Snapshot{{
+				Name: "20220102T100000UTC", Desc: "merged", AuthorEmail: email, FileCount: 3,
+				Parents: []SnapshotRef{{email, "20220101T100000UTC"}, {"b@example.com", "20211231T100000UTC"}},
+				Origin: &SnapshotOrigin{OriginMerge, SnapshotRef{"b@example.com", "20211231T100000UTC"}},
+			}},
+			false,
+		},
+		{"version 2 without snapshots", `{"version": 2}`, []Snapshot{}, false},
+		{"newer version", `{"version": 3, "snapshots": []}`, nil, true},
+		{"broken json", `{"version": 2,`, nil, true},
+		{"broken version 1", `[{"snapshot_name": 1}]`, nil, true},
+	}
+
+	for _, c := range cases {
+		got, err := parseManifest(email, []byte(c.raw))
+		if c.fails {
+			if err == nil {
+				t.Errorf("%s: parsed without an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if ! reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+
+func TestParseManifestMigration(t *testing.T) {
+	// a version 1 manifest saved again is version 2 and reads back the same.
+	email := "a@example.com"
+	v1 := `[{"snapshot_name": "20220102T100000UTC", "snapshot_desc": "second"},
+		{"snapshot_name": "20220101T100000UTC", "snapshot_desc": "first"}]`
+	snapshots, err := parseManifest(email, []byte(v1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonBytes, err := json.Marshal(Manifest{ManifestVersion, snapshots})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(jsonBytes, &manifest); err != nil || manifest.Version != ManifestVersion {
+		t.Fatalf("saved as %s", jsonBytes)
+	}
+	again, err := parseManifest(email, jsonBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ! reflect.DeepEqual(again, snapshots) {
+		t.Errorf("got %+v after saving, want %+v", again, snapshots)
+	}
+}
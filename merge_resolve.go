@@ -0,0 +1,392 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/otiai10/copy"
+	"github.com/pkg/errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+// MergeSegment is a part of a file being merged: lines both sides agree on, or a
+// conflict between the lines of each side.
+type MergeSegment struct {
+	Text string
+	Conflict bool
+	Yours string
+	Other string
+	OtherLabel string
+}
+
+
+// parseMergeSegments splits a merged file at its conflict markers.
+func parseMergeSegments(text string) []MergeSegment {
+	segments := make([]MergeSegment, 0)
+	var current *MergeSegment
+	inOther := false
+	plain := ""
+	for _, line := range splitLines(text) {
+		switch {
+		case current == nil && strings.HasPrefix(line, conflictStartMarker):
+			if plain != "" {
+				segments = append(segments, MergeSegment{Text: plain})
+				plain = ""
+			}
+			current = &MergeSegment{Conflict: true}
+			inOther = false
+		case current != nil && ! inOther && strings.TrimRight(line, "\r\n") == conflictMidMarker:
+			inOther = true
+		case current != nil && inOther && strings.HasPrefix(line, conflictEndMarker):
+			current.OtherLabel = strings.TrimSpace(strings.TrimPrefix(line, conflictEndMarker))
+			segments = append(segments, *current)
+			current = nil
+		case current != nil && inOther:
+			current.Other += line
+		case current != nil:
+			current.Yours += line
+		default:
+			plain += line
+		}
+	}
+
+	// an unfinished conflict is left as it is.
+	if current != nil {
+		plain += conflictStartMarker + "yours\n" + current.Yours
+		if inOther {
+			plain += conflictMidMarker + "\n" + current.Other
+		}
+	}
+	if plain != "" {
+		segments = append(segments, MergeSegment{Text: plain})
+	}
+	return segments
+}
+
+
+func joinMergeSegments(segments []MergeSegment) string {
+	lines := make([]string, 0)
+	for _, segment := range segments {
+		if segment.Conflict {
+			lines = writeConflict(lines, splitLines(segment.Yours), splitLines(segment.Other), segment.OtherLabel)
+		} else {
+			lines = append(lines, segment.Text)
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+
+// remainingConflicts returns how many conflicts of a conflicted file are not
+// resolved in merging_final.
+func remainingConflicts(finalPath string, conflict MergeConflict) (int, error) {
+	raw, exists, err := readMergeFile(finalPath, conflict.Path)
+	if err != nil {
+		return 0, err
+	}
+	if conflict.DeletedBy != "" {
+		if exists || conflict.Removed {
+			return 0, nil
+		}
+		return 1, nil
+	}
+	if conflict.Binary {
+		if exists {
+			return 0, nil
+		}
+		return 1, nil
+	}
+	return countConflictMarkers(raw), nil
+}
+
+
+// findMergeConflict returns the conflict of a file being merged, making sure the
+// path came from the merge and not from a crafted link.
+func findMergeConflict(projectName, shortPath string) (MergeConflict, error) {
+	conflicts, err := getMergeConflicts(projectName)
+	if err != nil {
+		return MergeConflict{}, err
+	}
+	for _, conflict := range conflicts {
+		if conflict.Path == shortPath {
+			return conflict, nil
+		}
+	}
+	return MergeConflict{}, errors.New(shortPath + " is not a conflicted file of this merger.")
+}
+
+
+func viewMerge(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectName := vars["proj"]
+	rootPath, _ := GetRootPath()
+	finalPath := filepath.Join(rootPath, "p", projectName, "merging_final")
+
+	rawMergingDetails, err := os.ReadFile(filepath.Join(rootPath, "p", projectName, ".merging_details.txt"))
+	if os.IsNotExist(err) {
+		errorPage(w, errors.New("There is no merger in progress."))
+		return
+	}
+	if err != nil {
+		errorPage(w, errors.Wrap(err, "os error"))
+		return
+	}
+	partsOfMergingDetails := strings.Split(strings.TrimSpace(string(rawMergingDetails)), "\n")
+	merging := Snapshot{AuthorEmail: partsOfMergingDetails[0], Name: partsOfMergingDetails[1]}
+	projects, err := getAllProjects()
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	conflicts, err := getMergeConflicts(projectName)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+
+	type FileStatus struct {
+		MergeConflict
+		Remaining int
+	}
+	files := make([]FileStatus, 0)
+	allResolved := true
+	for _, conflict := range conflicts {
+		remaining, err := remainingConflicts(finalPath, conflict)
+		if err != nil {
+			errorPage(w, err)
+			return
+		}
+		if remaining > 0 {
+			allResolved = false
+		}
+		files = append(files, FileStatus{conflict, remaining})
+	}
+
+	type Context struct {
+		Projects []string
+		CurrentProject string
+		Merging Snapshot
+		Files []FileStatus
+		AllResolved bool
+		FileLink func(string) string
+		SnapshotTime func(string) string
+	}
+	st := func(s string) string {
+		timeParsed, err :=  time.Parse(VersionFormat, s)
+		if err != nil {
+			return ""
+		}
+		return timeParsed.String()
+	}
+	fl := func(shortPath string) string {
+		return "/merge_file/" + projectName + "?path=" + url.QueryEscape(shortPath)
+	}
+	tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/merge.html"))
+	tmpl.Execute(w, Context{projects, projectName, merging, files, allResolved, fl, st})
+}
+
+
+func viewMergeFile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectName := vars["proj"]
+	shortPath := r.FormValue("path")
+	rootPath, _ := GetRootPath()
+	projectPath := filepath.Join(rootPath, "p", projectName)
+
+	conflict, err := findMergeConflict(projectName, shortPath)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	projects, err := getAllProjects()
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	remaining, err := remainingConflicts(filepath.Join(projectPath, "merging_final"), conflict)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+
+	type Context struct {
+		Projects []string
+		CurrentProject string
+		Path string
+		Binary bool
+		DeletedBy string
+		Remaining int
+		Yours string
+		Other string
+		Result string
+		Segments []MergeSegment
+	}
+	ctx := Context{Projects: projects, CurrentProject: projectName, Path: shortPath, Binary: conflict.Binary,
+		DeletedBy: conflict.DeletedBy, Remaining: remaining}
+
+	if conflict.DeletedBy != "" {
+		// only the changed version can be shown.
+		for _, side := range []struct{dir string; out *string} {
+			{"merging_yours", &ctx.Yours}, {"merging_other", &ctx.Other},
+		} {
+			raw, _, err := readMergeFile(filepath.Join(projectPath, side.dir), shortPath)
+			if err != nil {
+				errorPage(w, err)
+				return
+			}
+			ctx.Binary = ctx.Binary || ! isTextFile(raw)
+			*side.out = string(raw)
+		}
+		if ctx.Binary {
+			ctx.Yours, ctx.Other = "", ""
+		}
+	} else if ! conflict.Binary {
+		for _, side := range []struct{dir string; out *string} {
+			{"merging_yours", &ctx.Yours}, {"merging_other", &ctx.Other}, {"merging_final", &ctx.Result},
+		} {
+			raw, _, err := readMergeFile(filepath.Join(projectPath, side.dir), shortPath)
+			if err != nil {
+				errorPage(w, err)
+				return
+			}
+			*side.out = string(raw)
+		}
+		ctx.Segments = parseMergeSegments(ctx.Result)
+	}
+
+	tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/merge_file.html"))
+	tmpl.Execute(w, ctx)
+}
+
+
+// resolveConflict applies a choice made on the merge file page: taking a side
+// for one conflict, saving an edit of it or of the whole file, for binary files
+// taking one side's file, or for a file deleted on one side, keeping or removing it.
+func resolveConflict(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectName := vars["proj"]
+	shortPath := r.FormValue("path")
+	rootPath, _ := GetRootPath()
+	projectPath := filepath.Join(rootPath, "p", projectName)
+	finalFilePath := filepath.Join(projectPath, "merging_final", shortPath)
+
+	conflict, err := findMergeConflict(projectName, shortPath)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+
+	action := r.FormValue("action")
+	switch action {
+	case "keep", "remove":
+		if conflict.DeletedBy == "" {
+			errorPage(w, errors.New(shortPath + " was not deleted on either side."))
+			return
+		}
+		from := "merging_yours"
+		if conflict.DeletedBy == "yours" {
+			from = "merging_other"
+		}
+		if action == "keep" {
+			err = copy.Copy(filepath.Join(projectPath, from, shortPath), finalFilePath)
+		} else {
+			err = os.RemoveAll(finalFilePath)
+		}
+		if err != nil {
+			errorPage(w, errors.Wrap(err, "os error"))
+			return
+		}
+		err = setConflictRemoved(projectName, shortPath, action == "remove")
+		if err != nil {
+			errorPage(w, err)
+			return
+		}
+
+	case "use_mine", "use_theirs":
+		if ! conflict.Binary || conflict.DeletedBy != "" {
+			errorPage(w, errors.New("Only binary files are taken whole from one side."))
+			return
+		}
+		from := "merging_yours"
+		if action == "use_theirs" {
+			from = "merging_other"
+		}
+		err = copy.Copy(filepath.Join(projectPath, from, shortPath), finalFilePath)
+		if err != nil {
+			errorPage(w, errors.Wrap(err, "copy error"))
+			return
+		}
+
+	case "save_file":
+		err = os.WriteFile(finalFilePath, []byte(strings.ReplaceAll(r.FormValue("text"), "\r\n", "\n")), 0777)
+		if err != nil {
+			errorPage(w, errors.Wrap(err, "os error"))
+			return
+		}
+
+	default:
+		if conflict.Binary || conflict.DeletedBy != "" {
+			errorPage(w, errors.New("A binary file can only be taken whole from one side."))
+			return
+		}
+		raw, err := os.ReadFile(finalFilePath)
+		if err != nil {
+			errorPage(w, errors.Wrap(err, "os error"))
+			return
+		}
+		segments := parseMergeSegments(string(raw))
+		hunk, err := strconv.Atoi(r.FormValue("hunk"))
+		if err != nil || hunk < 0 || hunk >= len(segments) || ! segments[hunk].Conflict {
+			errorPage(w, errors.New("The conflict was not found. The file may have changed since the page was opened."))
+			return
+		}
+
+		segment := segments[hunk]
+		switch action {
+		case "mine":
+			segment = MergeSegment{Text: segment.Yours}
+		case "theirs":
+			segment = MergeSegment{Text: segment.Other}
+		case "both":
+			segment = MergeSegment{Text: segment.Yours + segment.Other}
+		case "edit":
+			text := strings.ReplaceAll(r.FormValue("text"), "\r\n", "\n")
+			if text != "" && ! strings.HasSuffix(text, "\n") {
+				text += "\n"
+			}
+			segment = MergeSegment{Text: text}
+		default:
+			errorPage(w, errors.New("unknown action: " + action))
+			return
+		}
+		segments[hunk] = segment
+
+		err = os.WriteFile(finalFilePath, []byte(joinMergeSegments(segments)), 0777)
+		if err != nil {
+			errorPage(w, errors.Wrap(err, "os error"))
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/merge_file/" + projectName + "?path=" + url.QueryEscape(shortPath), 307)
+}
+
+
+func setConflictRemoved(projectName, shortPath string, removed bool) error {
+	conflicts, err := getMergeConflicts(projectName)
+	if err != nil {
+		return err
+	}
+	for i := range conflicts {
+		if conflicts[i].Path == shortPath {
+			conflicts[i].Removed = removed
+		}
+	}
+	return writeMergeConflicts(projectName, conflicts)
+}
@@ -1,29 +1,42 @@
 package main
 
 import (
+	"html/template"
 	"net/http"
 	"github.com/gorilla/mux"
 	"path/filepath"
   "github.com/otiai10/copy"
-  "encoding/json"
   "github.com/pkg/errors"
   "os"
-	archiver "github.com/mholt/archiver/v3"
 	"strings"
 	"bytes"
 	"time"
 	"fmt"
 	"io/fs"
+	"encoding/json"
+	"sort"
 
 )
 
 
+// startMerge merges a snapshot of a member into your latest snapshot. Without a
+// snapshot name in the route the member's latest snapshot is merged.
+//
+// When the project folder has changes that are not in your latest snapshot, the
+// form value "uncommitted" says what to do with them: "stash" puts a copy aside
+// to apply after the merger and "merge" merges the project folder instead of
+// your latest snapshot. Without it the choices are shown.
 func startMerge(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	projectName := vars["proj"]
 	otherEmail := vars["email"]
 	rootPath, _ := GetRootPath()
 
+	if DoesPathExists(filepath.Join(rootPath, "p", projectName, ".merging_details.txt")) {
+		errorPage(w, errors.New("A merger is already in progress. Complete or cancel it first."))
+		return
+	}
+
 	pd, err := getProjectData(projectName)
 	if err != nil {
 		errorPage(w, err)
@@ -34,159 +47,494 @@ func startMerge(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, err)
 		return
 	}
-	sakPath := filepath.Join(rootPath, pd["sak_json"])
-
-	// download and unpack the lastest snapshot of other
-	latestOtherSnapshots := make([]map[string]string, 0)
-	manifestRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, otherEmail + "/manifest.json")
+	store, err := getStore(pd)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
 
-	err = json.Unmarshal(manifestRaw, &latestOtherSnapshots)
+	// download and unpack the chosen snapshot of other
+	otherSnapshots, err := getManifest(store, otherEmail)
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "json error"))
+		errorPage(w, err)
+		return
+	}
+	if len(otherSnapshots) == 0 {
+		errorPage(w, errors.New(otherEmail + " has no snapshots to merge with."))
 		return
 	}
+	otherSnapshot := &otherSnapshots[0]
+	if vars["sname"] != "" {
+		otherSnapshot = findSnapshot(otherSnapshots, vars["sname"])
+		if otherSnapshot == nil {
+			errorPage(w, errors.New("The snapshot " + vars["sname"] + " does not exist."))
+			return
+		}
+	}
 
-	latestOtherSnapshotName := latestOtherSnapshots[0]["snapshot_name"]
+	otherSnapshotName := otherSnapshot.Name
 
-	latestOtherSnapshotRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, otherEmail + "/" + latestOtherSnapshotName + ".tar.gz")
+	otherSnapshotUndoPath, releaseOther, err := getCachedSnapshot(store, projectName, otherEmail, otherSnapshotName, otherSnapshot.Hash)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	latestOtherSnapshotPath := filepath.Join(rootPath, "flotmp", projectName, latestOtherSnapshotName + ".tar.gz")
-	os.MkdirAll(filepath.Join(rootPath, "flotmp", projectName), 0777)
-	err = os.WriteFile(latestOtherSnapshotPath, latestOtherSnapshotRaw, 0777)	
+	defer releaseOther()
+
+
+	// download and unpack the lastest snapshot of the user
+	snapshots, err := getManifest(store, userData.Email)
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "os error"))
+		errorPage(w, err)
 		return
 	}
-	latestOtherSnapshotUndoPath := filepath.Join(rootPath, "flotmp", projectName, latestOtherSnapshotName)
-	os.RemoveAll(latestOtherSnapshotUndoPath)
-	err = archiver.Unarchive(latestOtherSnapshotPath, latestOtherSnapshotUndoPath)
-	if err != nil {
-		errorPage(w, errors.Wrap(err, "archiver error"))
+	if len(snapshots) == 0 {
+		errorPage(w, errors.New("Create a snapshot of your own before merging."))
 		return
 	}
 
+	snapshotName := snapshots[0].Name
 
-	// download and unpack the lastest snapshot of the user
-	snapshots := make([]map[string]string, 0)
-	manifestRaw, err = downloadFileAsBytes(pd["project_name"], sakPath, userData["email"] + "/manifest.json")
+	snapshotUndoPath, releaseYours, err := getCachedSnapshot(store, projectName, userData.Email, snapshotName, snapshots[0].Hash)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
+	defer releaseYours()
 
-	err = json.Unmarshal(manifestRaw, &snapshots)
+	// the merge base is the latest snapshot both sides were built on. Without one
+	// every difference counts as a change on both sides.
+	graph, err := getHistoryGraph(store)
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "json error"))
+		errorPage(w, err)
 		return
 	}
+	yoursRef := SnapshotRef{userData.Email, snapshotName}
+	otherRef := SnapshotRef{otherEmail, otherSnapshotName}
+	if otherRef == yoursRef {
+		errorPage(w, errors.New("A snapshot cannot be merged with itself."))
+		return
+	}
+	basePath := filepath.Join(rootPath, "flotmp", UntestedRandomString(10))
+	var baseRef SnapshotRef
+	hasBase := false
+	olderOfYours := graph.isAncestor(otherRef, yoursRef)
+	if olderOfYours {
+		// an older snapshot of your own is merged without a base, so that every
+		// difference from it can be taken or left file by file. The files deleted
+		// since are asked about below rather than brought back.
+		if otherEmail != userData.Email {
+			errorPage(w, errors.New("Your snapshots already have all the work of this snapshot of " + otherEmail + "."))
+			return
+		}
+	} else {
+		baseRef, hasBase = graph.mergeBase(yoursRef, otherRef)
+	}
+	if hasBase {
+		var releaseBase func()
+		basePath, releaseBase, err = getCachedSnapshot(store, projectName, baseRef.Email, baseRef.Name, graph.Snapshots[baseRef].Hash)
+		if err != nil {
+			errorPage(w, err)
+			return
+		}
+		defer releaseBase()
+	}
 
-	snapshotName := snapshots[0]["snapshot_name"]
-
-	snapshotRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, userData["email"] + "/" + snapshotName + ".tar.gz")
+	// completing the merger replaces the project folder, so changes made since
+	// your latest snapshot are dealt with first. This comes after every check that
+	// can refuse the merger, so nothing is put aside for a merger that never starts.
+	changes, err := workingTreeChanges(projectName, snapshotUndoPath)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	snapshotPath := filepath.Join(rootPath, "flotmp", projectName, snapshotName + ".tar.gz")
-	os.MkdirAll(filepath.Join(rootPath, "flotmp", projectName), 0777)
-	err = os.WriteFile(snapshotPath, snapshotRaw, 0777)	
+	yoursPath := snapshotUndoPath
+	if len(changes) > 0 {
+		switch r.FormValue("uncommitted") {
+		case "stash":
+			err = stashWorkingTree(projectName, snapshotName, changes)
+		case "merge":
+			yoursPath = filepath.Join(rootPath, "flotmp", UntestedRandomString(10))
+			defer os.RemoveAll(yoursPath)
+			err = copyWorkingTree(projectName, yoursPath)
+		default:
+			projects, err := getAllProjects()
+			if err != nil {
+				errorPage(w, err)
+				return
+			}
+			type Context struct {
+				Projects []string
+				CurrentProject string
+				Changes []string
+				MergeURL string
+			}
+			tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/merge_uncommitted.html"))
+			tmpl.Execute(w, Context{projects, projectName, changes, r.URL.Path})
+			return
+		}
+		if err != nil {
+			errorPage(w, err)
+			return
+		}
+	}
+
+	// finished preparations. starting the merging.
+	finalPath := filepath.Join(rootPath, "p", projectName, "merging_final")
+	fromYoursPath := filepath.Join(rootPath, "p", projectName, "merging_yours")
+	fromOtherPath := filepath.Join(rootPath, "p", projectName, "merging_other")
+
+	os.MkdirAll(finalPath, 0777)
+	os.MkdirAll(fromYoursPath, 0777)
+	os.MkdirAll(fromOtherPath, 0777)
+
+	conflicts, err := threeWayMerge(basePath, yoursPath, otherSnapshotUndoPath, finalPath,
+		fromYoursPath, fromOtherPath, otherEmail)
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "os error"))
+		errorPage(w, err)
 		return
 	}
-	snapshotUndoPath := filepath.Join(rootPath, "flotmp", projectName, snapshotName)
-	os.RemoveAll(snapshotUndoPath)
-	err = archiver.Unarchive(snapshotPath, snapshotUndoPath)
+	if olderOfYours {
+		conflicts, err = markDeletedByYours(yoursPath, otherSnapshotUndoPath, finalPath, fromOtherPath, conflicts)
+		if err != nil {
+			errorPage(w, err)
+			return
+		}
+	}
+	err = writeMergeConflicts(projectName, conflicts)
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "archiver error"))
+		errorPage(w, err)
 		return
 	}
 
-	// finished preparations. starting the merging.
-	otherFileList, err := getAllFilesList(latestOtherSnapshotUndoPath)
+	err = writeMergingTreeState(projectName)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	currentUserFileList, err := getAllFilesList(snapshotUndoPath)
+
+	err = os.WriteFile(filepath.Join(rootPath, "p", projectName, ".merging_details.txt"),
+		[]byte(otherEmail + "\n" + otherSnapshotName + "\n" + baseRef.Email + "\n" + baseRef.Name), 0777)
 	if err != nil {
-		errorPage(w, err)
+		errorPage(w, errors.Wrap(err, "os error"))
 		return
 	}
 
+	http.Redirect(w, r, "/view_project/" + projectName, 307)
+}
+
+
+
+// readMergeFile returns the contents of a file of one side of a merge and if it
+// exists there.
+func readMergeFile(dirPath, shortPath string) ([]byte, bool, error) {
+	raw, err := os.ReadFile(filepath.Join(dirPath, shortPath))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, "os error")
+	}
+	return raw, true, nil
+}
+
+
+// MergeConflict is a file both sides of a merge changed in the same places. A text
+// file is in merging_final with Count conflicts between markers. A binary file
+// cannot be merged, so it is resolved by putting a version in merging_final.
+//
+// When one side deleted a file the other changed, DeletedBy is the side that
+// deleted it ("yours" or "theirs") and the changed version is in merging_yours or
+// merging_other. It is resolved by putting that version in merging_final or by
+// choosing to leave the file out, which sets Removed.
+type MergeConflict struct {
+	Path string `json:"path"`
+	Count int `json:"count"`
+	Binary bool `json:"binary"`
+	DeletedBy string `json:"deleted_by,omitempty"`
+	Removed bool `json:"removed,omitempty"`
+}
+
+
+func getMergeConflicts(projectName string) ([]MergeConflict, error) {
+	rootPath, _ := GetRootPath()
+	conflicts := make([]MergeConflict, 0)
+	conflictsPath := filepath.Join(rootPath, "p", projectName, ".merging_conflicts.json")
+	if ! DoesPathExists(conflictsPath) {
+		return conflicts, nil
+	}
+	raw, err := os.ReadFile(conflictsPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "os error")
+	}
+	err = json.Unmarshal(raw, &conflicts)
+	if err != nil {
+		return nil, errors.Wrap(err, "json error")
+	}
+	return conflicts, nil
+}
+
+
+func writeMergeConflicts(projectName string, conflicts []MergeConflict) error {
+	rootPath, _ := GetRootPath()
+	jsonBytes, err := json.Marshal(conflicts)
+	if err != nil {
+		return errors.Wrap(err, "json error")
+	}
+	err = os.WriteFile(filepath.Join(rootPath, "p", projectName, ".merging_conflicts.json"), jsonBytes, 0777)
+	if err != nil {
+		return errors.Wrap(err, "os error")
+	}
+	return nil
+}
+
+
+// unresolvedConflicts returns the conflicted files of a merge that still have
+// conflict markers, or for binary files, that have no version in merging_final.
+func unresolvedConflicts(projectName string) ([]string, error) {
+	rootPath, _ := GetRootPath()
 	finalPath := filepath.Join(rootPath, "p", projectName, "merging_final")
-	fromYoursPath := filepath.Join(rootPath, "p", projectName, "merging_yours")
-	fromOtherPath := filepath.Join(rootPath, "p", projectName, "merging_other")
+	conflicts, err := getMergeConflicts(projectName)
+	if err != nil {
+		return nil, err
+	}
 
-	os.MkdirAll(finalPath, 0777)
-	os.MkdirAll(fromYoursPath, 0777)
-	os.MkdirAll(fromOtherPath, 0777)
+	unresolved := make([]string, 0)
+	for _, conflict := range conflicts {
+		remaining, err := remainingConflicts(finalPath, conflict)
+		if err != nil {
+			return nil, err
+		}
+		if remaining > 0 {
+			unresolved = append(unresolved, conflict.Path)
+		}
+	}
+	return unresolved, nil
+}
 
 
-	for _, path := range currentUserFileList {
-		shortPath := strings.ReplaceAll(path, snapshotUndoPath + "/", "")
-		if DoesPathExists(filepath.Join(latestOtherSnapshotUndoPath, shortPath)) {
-			// do a deep compare
-			rawNew, err := os.ReadFile(path)
-			if err != nil {
-				errorPage(w, errors.Wrap(err, "os error"))
-				return
-			}
-			rawOld, err := os.ReadFile(filepath.Join(latestOtherSnapshotUndoPath, shortPath))
-			if err != nil {
-				errorPage(w, errors.Wrap(err, "os error"))
-				return
-			}
+// threeWayMerge merges the files of yours and other with base as their common
+// ancestor. A file changed on one side only is taken from that side into
+// finalPath, and a file deleted on one side and left alone on the other stays
+// deleted. Text files both sides changed are merged line by line into finalPath,
+// with conflict markers where both changed the same lines. Both versions of such
+// files are also copied to fromYoursPath and fromOtherPath.
+//
+// A file renamed on one side is merged with the other side's version under its
+// new name, as found by mergeRenames.
+//
+// Without a base a file missing on one side counts as added by the other.
+func threeWayMerge(basePath, yoursPath, otherPath, finalPath, fromYoursPath, fromOtherPath,
+	otherLabel string) ([]MergeConflict, error) {
+
+	conflicts := make([]MergeConflict, 0)
+	shortPaths := make(map[string]bool)
+	for _, dirPath := range []string{yoursPath, otherPath} {
+		files, err := getAllFilesList(dirPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range files {
+			shortPaths[strings.Replace(p, dirPath + "/", "", 1)] = true
+		}
+	}
 
-			if bytes.Equal(rawNew, rawOld) {
-				copy.Copy(path, filepath.Join(finalPath, shortPath))
-			} else {
-				copy.Copy(path, filepath.Join(fromYoursPath, shortPath))
-				copy.Copy(filepath.Join(latestOtherSnapshotUndoPath, shortPath),
-					filepath.Join(fromOtherPath, shortPath))
+	renamed := make(map[string][3]string)
+	if DoesPathExists(basePath) {
+		var err error
+		renamed, err = mergeRenames(basePath, yoursPath, otherPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, names := range renamed {
+		// the old names are merged under the new one.
+		for _, name := range names {
+			if _, ok := renamed[name]; ! ok {
+				delete(shortPaths, name)
 			}
-		} else {
-			copy.Copy(path, filepath.Join(finalPath, shortPath))
 		}
 	}
 
-	for _, path := range otherFileList {
-		shortPath := strings.ReplaceAll(path, latestOtherSnapshotUndoPath + "/", "")
-		if ! DoesPathExists(filepath.Join(snapshotUndoPath, shortPath)) {
-			copy.Copy(path, filepath.Join(finalPath, shortPath))
+	for shortPath := range shortPaths {
+		names, ok := renamed[shortPath]
+		if ! ok {
+			names = [3]string{shortPath, shortPath, shortPath}
+		}
+		baseName, yoursName, otherName := names[0], names[1], names[2]
+		rawBase, inBase, err := readMergeFile(basePath, baseName)
+		if err != nil {
+			return nil, err
+		}
+		rawYours, inYours, err := readMergeFile(yoursPath, yoursName)
+		if err != nil {
+			return nil, err
+		}
+		rawOther, inOther, err := readMergeFile(otherPath, otherName)
+		if err != nil {
+			return nil, err
+		}
+		yoursChanged := inYours != inBase || ! bytes.Equal(rawYours, rawBase)
+		otherChanged := inOther != inBase || ! bytes.Equal(rawOther, rawBase)
+
+		switch {
+		case inYours && inOther && bytes.Equal(rawYours, rawOther):
+			err = copy.Copy(filepath.Join(yoursPath, yoursName), filepath.Join(finalPath, shortPath))
+		case ! inOther && inBase && yoursChanged:
+			conflicts = append(conflicts, MergeConflict{Path: shortPath, Count: 1, DeletedBy: "theirs"})
+			err = copy.Copy(filepath.Join(yoursPath, yoursName), filepath.Join(fromYoursPath, shortPath))
+		case ! inYours && inBase && otherChanged:
+			conflicts = append(conflicts, MergeConflict{Path: shortPath, Count: 1, DeletedBy: "yours"})
+			err = copy.Copy(filepath.Join(otherPath, otherName), filepath.Join(fromOtherPath, shortPath))
+		case ! inOther && inBase, ! inYours && inBase:
+			// deleted on one side, untouched on the other.
+		case ! inOther || (inYours && ! otherChanged):
+			err = copy.Copy(filepath.Join(yoursPath, yoursName), filepath.Join(finalPath, shortPath))
+		case ! inYours || ! yoursChanged:
+			err = copy.Copy(filepath.Join(otherPath, otherName), filepath.Join(finalPath, shortPath))
+		default:
+			binary := ! isTextFile(rawBase) || ! isTextFile(rawYours) || ! isTextFile(rawOther)
+			count := 1
+			if ! binary {
+				var merged []byte
+				merged, count = mergeText(rawBase, rawYours, rawOther, otherLabel)
+				err = copy.Copy(filepath.Join(yoursPath, yoursName), filepath.Join(finalPath, shortPath))
+				if err == nil {
+					err = os.WriteFile(filepath.Join(finalPath, shortPath), merged, 0777)
+				}
+			}
+			if err == nil && count > 0 {
+				conflicts = append(conflicts, MergeConflict{Path: shortPath, Count: count, Binary: binary})
+				err = copy.Copy(filepath.Join(yoursPath, yoursName), filepath.Join(fromYoursPath, shortPath))
+				if err == nil {
+					err = copy.Copy(filepath.Join(otherPath, otherName), filepath.Join(fromOtherPath, shortPath))
+				}
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "copy error")
 		}
 	}
 
-	err = os.WriteFile(filepath.Join(rootPath, "p", projectName, ".merging_details.txt"),
-		[]byte(otherEmail + "\n" + latestOtherSnapshotName), 0777)
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Path < conflicts[j].Path
+	})
+	return conflicts, nil
+}
+
+
+// markDeletedByYours is for merging an older snapshot of your own, which has no
+// base. The files of the older snapshot that yours no longer has were deleted
+// since, so instead of coming back as added they become conflicts deleted by you
+// with the older version in fromOtherPath, to be kept or left out one by one.
+func markDeletedByYours(yoursPath, otherPath, finalPath, fromOtherPath string,
+	conflicts []MergeConflict) ([]MergeConflict, error) {
+
+	files, err := getAllFilesList(otherPath)
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "os error"))
-		return
+		return nil, err
+	}
+	for _, p := range files {
+		shortPath := strings.Replace(p, otherPath + "/", "", 1)
+		if DoesPathExists(filepath.Join(yoursPath, shortPath)) {
+			continue
+		}
+		err = os.Remove(filepath.Join(finalPath, shortPath))
+		if err != nil && ! os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "os error")
+		}
+		err = copy.Copy(p, filepath.Join(fromOtherPath, shortPath))
+		if err != nil {
+			return nil, errors.Wrap(err, "copy error")
+		}
+		conflicts = append(conflicts, MergeConflict{Path: shortPath, Count: 1, DeletedBy: "yours"})
 	}
 
-	http.Redirect(w, r, "/view_project/" + projectName, 307)
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Path < conflicts[j].Path
+	})
+	return conflicts, nil
 }
 
 
-
 func cancelMerge(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	projectName := vars["proj"]
 	rootPath, _ := GetRootPath()
 
+	clearMergeState(projectName)
+	os.RemoveAll(filepath.Join(rootPath, "p", projectName, "merging_final"))
+
+	http.Redirect(w, r, "/view_snapshots/" + projectName, 307)
+}
+
+
+// clearMergeState removes everything a merger keeps in the project folder but
+// merging_final.
+func clearMergeState(projectName string) {
+	rootPath, _ := GetRootPath()
 	os.RemoveAll(filepath.Join(rootPath, "p", projectName, ".merging_details.txt"))
+	os.RemoveAll(filepath.Join(rootPath, "p", projectName, ".merging_conflicts.json"))
+	os.RemoveAll(filepath.Join(rootPath, "p", projectName, ".merging_tree.json"))
 	os.RemoveAll(filepath.Join(rootPath, "p", projectName, "merging_other"))
 	os.RemoveAll(filepath.Join(rootPath, "p", projectName, "merging_yours"))
-	os.RemoveAll(filepath.Join(rootPath, "p", projectName, "merging_final"))
+}
 
-	http.Redirect(w, r, "/view_snapshots/" + projectName, 307)
+
+// writeMergingTreeState records the project folder as it is when a merger starts,
+// so that completing the merger cannot replace changes made during it.
+func writeMergingTreeState(projectName string) error {
+	rootPath, _ := GetRootPath()
+	state, err := workingTreeState(projectName)
+	if err != nil {
+		return err
+	}
+	jsonBytes, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "json error")
+	}
+	err = os.WriteFile(filepath.Join(rootPath, "p", projectName, ".merging_tree.json"), jsonBytes, 0777)
+	if err != nil {
+		return errors.Wrap(err, "os error")
+	}
+	return nil
+}
+
+
+// mergingTreeChanges returns the files of the project folder that changed since
+// the merger started. Mergers started before this was recorded report none.
+func mergingTreeChanges(projectName string) ([]string, error) {
+	rootPath, _ := GetRootPath()
+	statePath := filepath.Join(rootPath, "p", projectName, ".merging_tree.json")
+	changes := make([]string, 0)
+	if ! DoesPathExists(statePath) {
+		return changes, nil
+	}
+	raw, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "os error")
+	}
+	oldState := make(map[string]string)
+	err = json.Unmarshal(raw, &oldState)
+	if err != nil {
+		return nil, errors.Wrap(err, "json error")
+	}
+	state, err := workingTreeState(projectName)
+	if err != nil {
+		return nil, err
+	}
+	for shortPath, hash := range state {
+		if oldState[shortPath] != hash {
+			changes = append(changes, shortPath)
+		}
+	}
+	for shortPath := range oldState {
+		if _, ok := state[shortPath]; ! ok {
+			changes = append(changes, shortPath)
+		}
+	}
+	sort.Strings(changes)
+	return changes, nil
 }
 
 
@@ -229,7 +577,6 @@ func completeMerge(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	projectName := vars["proj"]
 	rootPath, _ := GetRootPath()
-	projectPath := filepath.Join(rootPath, "p", projectName)
 
 	pd, err := getProjectData(projectName)
 	if err != nil {
@@ -241,56 +588,41 @@ func completeMerge(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, err)
 		return
 	}
-	sakPath := filepath.Join(rootPath, pd["sak_json"])
-
-	finalPath := filepath.Join(rootPath, "p", projectName, "merging_final")
-	outObjs, err := getCleanFilesList2(projectName, finalPath)
+	store, err := getStore(pd)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	tmpPath := filepath.Join(rootPath, "flotmp", UntestedRandomString(10))
-	err = os.MkdirAll(tmpPath, 0777)
+
+	unresolved, err := unresolvedConflicts(projectName)
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "os error"))
+		errorPage(w, err)
 		return
 	}
-	for _, p := range outObjs {
-		newP := strings.Replace(p, finalPath + "/", "", 1)
-		copy.Copy(p, filepath.Join(tmpPath, newP))
+	if len(unresolved) > 0 {
+		errorPage(w, errors.New("These files still have merge conflicts to resolve in merging_final:\n" +
+			strings.Join(unresolved, "\n")))
+		return
 	}
 
-	objFIs, err := os.ReadDir(tmpPath)
+	changedDuring, err := mergingTreeChanges(projectName)
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "os error"))
+		errorPage(w, err)
 		return
 	}
-
-	toArchivePaths := make([]string, 0)
-	for _, objFI := range objFIs {
-		toArchivePaths = append(toArchivePaths, filepath.Join(tmpPath, objFI.Name()))
+	if len(changedDuring) > 0 {
+		errorPage(w, errors.New("These files of the project folder changed after the merger started and " +
+			"completing it would replace them. Copy the changes into merging_final or cancel the merger:\n" +
+			strings.Join(changedDuring, "\n")))
+		return
 	}
 
-  snapshotName := time.Now().Format(VersionFormat)
-  outFilePath := filepath.Join(rootPath, "flotmp", snapshotName + ".tar.gz")
-  err = archiver.Archive(toArchivePaths, outFilePath)
-  if err != nil {
-  	errorPage(w, errors.Wrap(err, "archiver error"))
-  	return
-  }
-
-  raw, err := os.ReadFile(outFilePath)
-  if err != nil {
-  	errorPage(w, errors.Wrap(err, "os error"))
-  	return
-  }
-
-  err = uploadFile(pd["gcp_bucket"], sakPath, userData["email"] + "/" + snapshotName + ".tar.gz", raw)
-  if err != nil {
-  	errorPage(w, errors.Wrap(err, "storage error"))
-  	return
-  }		  
-
+	finalPath := filepath.Join(rootPath, "p", projectName, "merging_final")
+	outObjs, err := getCleanFilesList2(projectName, finalPath)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
   rawMergingDetails, err := os.ReadFile(filepath.Join(rootPath, "p", projectName, ".merging_details.txt"))
   if err != nil {
   	errorPage(w, errors.Wrap(err, "os error"))
@@ -306,45 +638,36 @@ func completeMerge(w http.ResponseWriter, r *http.Request) {
 		return timeParsed.String()
 	}
 
-	manifestObj := make([]map[string]string, 0)
-	manifestRaw, err := downloadFileAsBytes(pd["gcp_bucket"], sakPath, userData["email"] + "/manifest.json")
-	if err != nil {
-		errorPage(w, err)
-		return
-	}
-	err = json.Unmarshal(manifestRaw, &manifestObj)
-	if err != nil {
-		errorPage(w, errors.Wrap(err, "json error"))
-		return
-	}
-
-	aManifestObj := map[string]string {
-		"snapshot_name": snapshotName,
-		"snapshot_desc": fmt.Sprintf("Merger with %s on %s", partsOfMergingDetails[0], st(partsOfMergingDetails[1])),
-	}
-
-	newManifestObj := append([]map[string]string{aManifestObj}, manifestObj...)
-
-	jsonBytes, err := json.Marshal(newManifestObj)
+	snapshot := newSnapshot(userData, fmt.Sprintf("Merger with %s on %s", partsOfMergingDetails[0], st(partsOfMergingDetails[1])))
+	snapshot.Origin = &SnapshotOrigin{OriginMerge, SnapshotRef{partsOfMergingDetails[0], partsOfMergingDetails[1]}}
+	snapshot.Parents = []SnapshotRef{snapshot.Origin.From}
+	snapshot.FileCount = len(outObjs)
+  snapshot.Hash, snapshot.Size, err = uploadSnapshotTree(store, userData.Email, snapshot.Name, finalPath, outObjs)
   if err != nil {
-  	errorPage(w, errors.Wrap(err, "json error"))
+  	errorPage(w, err)
   	return
   }
-  err = uploadFile(pd["gcp_bucket"], sakPath, userData["email"] + "/manifest.json", jsonBytes)
+
+  err = updateManifest(store, userData.Email, addSnapshotEntry(snapshot))
   if err != nil {
-  	errorPage(w, errors.Wrap(err, "storage error"))
+  	errorPage(w, err)
   	return
   }
 
-	tmpObjFIs, err := os.ReadDir(tmpPath)
+	// move the merged files out of the way before replacing the project folder.
+	keepPath := filepath.Join(rootPath, "flotmp", UntestedRandomString(10))
+	err = os.Rename(finalPath, keepPath)
 	if err != nil {
 		errorPage(w, errors.Wrap(err, "os error"))
 		return
 	}
+	defer os.RemoveAll(keepPath)
 
-	emptyDir(projectPath)
-	for _, tmpObjFI := range tmpObjFIs {
-		copy.Copy(filepath.Join(tmpPath, tmpObjFI.Name()), filepath.Join(projectPath, tmpObjFI.Name()))
+	clearMergeState(projectName)
+	err = replaceWorkingTree(projectName, keepPath)
+	if err != nil {
+		errorPage(w, err)
+		return
 	}
 
   http.Redirect(w, r, "/view_snapshots/" + projectName, 307)		  	
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+
+// writeTestTree creates dirPath with files given as short paths to contents. A nil
+// map leaves dirPath out.
+func writeTestTree(t *testing.T, dirPath string, files map[string]string) {
+	if files == nil {
+		return
+	}
+	err := os.MkdirAll(dirPath, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for shortPath, contents := range files {
+		p := filepath.Join(dirPath, shortPath)
+		os.MkdirAll(filepath.Dir(p), 0777)
+		err := os.WriteFile(p, []byte(contents), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+
+// readTestTree returns the files under dirPath as short paths to contents.
+func readTestTree(t *testing.T, dirPath string) map[string]string {
+	files := make(map[string]string)
+	if ! DoesPathExists(dirPath) {
+		return files
+	}
+	paths, err := getAllFilesList(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range paths {
+		raw, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[strings.Replace(p, dirPath + "/", "", 1)] = string(raw)
+	}
+	return files
+}
+
+
+func TestThreeWayMergeDeletes(t *testing.T) {
+	// the rename threshold is read from the settings under the home folder.
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SNAP_USER_COMMON", "")
+
+	cases := []struct {
+		name string
+		base, yours, other map[string]string
+		want map[string]string
+		conflicts []MergeConflict
+		fromYours, fromOther map[string]string
+	}{
+		{
+			name: "deleted by other, untouched by yours",
+			base: map[string]string{"a.txt": "a\n", "b.txt": "b\n"},
+			yours: map[string]string{"a.txt": "a\n", "b.txt": "b\n"},
+			other: map[string]string{"a.txt": "a\n"},
+			want: map[string]string{"a.txt": "a\n"},
+		},
+		{
+			name: "deleted by yours, untouched by other",
+			base: map[string]string{"a.txt": "a\n", "b.txt": "b\n"},
+			yours: map[string]string{"a.txt": "a\n"},
+			other: map[string]string{"a.txt": "a\n", "b.txt": "b\n"},
+			want: map[string]string{"a.txt": "a\n"},
+		},
+		{
+			name: "deleted by both",
+			base: map[string]string{"a.txt": "a\n", "b.txt": "b\n"},
+			yours: map[string]string{"a.txt": "a\n"},
+			other: map[string]string{"a.txt": "A\n"},
+			want: map[string]string{"a.txt": "A\n"},
+		},
+		{
+			name: "deleted by other, changed by yours",
+			base: map[string]string{"a.txt": "a\n", "b.txt": "b\n"},
+			yours: map[string]string{"a.txt": "a\n", "b.txt": "B\n"},
+			other: map[string]string{"a.txt": "a\n"},
+			want: map[string]string{"a.txt": "a\n"},
+			conflicts: []MergeConflict{{Path: "b.txt", Count: 1, DeletedBy: "theirs"}},
+			fromYours: map[string]string{"b.txt": "B\n"},
+		},
+		{
+			name: "deleted by yours, changed by other",
+			base: map[string]string{"a.txt": "a\n", "dir/b.txt": "b\n"},
+			yours: map[string]string{"a.txt": "a\n"},
+			other: map[string]string{"a.txt": "a\n", "dir/b.txt": "B\n"},
+			want: map[string]string{"a.txt": "a\n"},
+			conflicts: []MergeConflict{{Path: "dir/b.txt", Count: 1, DeletedBy: "yours"}},
+			fromOther: map[string]string{"dir/b.txt": "B\n"},
+		},
+		{
+			name: "deleted by other, added again by yours",
+			base: map[string]string{"a.txt": "a\n"},
+			yours: map[string]string{"a.txt": "a\n", "b.txt": "b\n"},
+			other: map[string]string{},
+			want: map[string]string{"b.txt": "b\n"},
+		},
+		{
+			name: "without a base, missing files are added",
+			base: nil,
+			yours: map[string]string{"a.txt": "a\n", "b.txt": "b\n"},
+			other: map[string]string{"a.txt": "a\n", "c.txt": "c\n"},
+			want: map[string]string{"a.txt": "a\n", "b.txt": "b\n", "c.txt": "c\n"},
+		},
+	}
+
+	for _, c := range cases {
+		dirPath := t.TempDir()
+		basePath, yoursPath, otherPath := filepath.Join(dirPath, "base"), filepath.Join(dirPath, "yours"),
+			filepath.Join(dirPath, "other")
+		finalPath, fromYoursPath, fromOtherPath := filepath.Join(dirPath, "final"),
+			filepath.Join(dirPath, "from_yours"), filepath.Join(dirPath, "from_other")
+		writeTestTree(t, basePath, c.base)
+		writeTestTree(t, yoursPath, c.yours)
+		writeTestTree(t, otherPath, c.other)
+
+		conflicts, err := threeWayMerge(basePath, yoursPath, otherPath, finalPath, fromYoursPath, fromOtherPath, "other")
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if c.conflicts == nil {
+			c.conflicts = []MergeConflict{}
+		}
+		if ! reflect.DeepEqual(conflicts, c.conflicts) {
+			t.Errorf("%s: got conflicts %+v, want %+v", c.name, conflicts, c.conflicts)
+		}
+		for _, tree := range []struct {
+			dirPath string
+			want map[string]string
+		}{{finalPath, c.want}, {fromYoursPath, c.fromYours}, {fromOtherPath, c.fromOther}} {
+			if tree.want == nil {
+				tree.want = map[string]string{}
+			}
+			if got := readTestTree(t, tree.dirPath); ! reflect.DeepEqual(got, tree.want) {
+				t.Errorf("%s: %s has %v, want %v", c.name, filepath.Base(tree.dirPath), got, tree.want)
+			}
+		}
+	}
+}
+
+
+func TestMarkDeletedByYours(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SNAP_USER_COMMON", "")
+
+	// other is an older snapshot of your own: b.txt was deleted since and a.txt changed.
+	dirPath := t.TempDir()
+	yoursPath, otherPath := filepath.Join(dirPath, "yours"), filepath.Join(dirPath, "other")
+	finalPath, fromYoursPath, fromOtherPath := filepath.Join(dirPath, "final"),
+		filepath.Join(dirPath, "from_yours"), filepath.Join(dirPath, "from_other")
+	writeTestTree(t, yoursPath, map[string]string{"a.txt": "a\nA\n", "c.txt": "c\n"})
+	writeTestTree(t, otherPath, map[string]string{"a.txt": "a\n", "b.txt": "b\n", "dir/d.txt": "d\n", "c.txt": "c\n"})
+
+	conflicts, err := threeWayMerge(filepath.Join(dirPath, "base"), yoursPath, otherPath, finalPath,
+		fromYoursPath, fromOtherPath, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflicts, err = markDeletedByYours(yoursPath, otherPath, finalPath, fromOtherPath, conflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []MergeConflict{
+		{Path: "a.txt", Count: 1},
+		{Path: "b.txt", Count: 1, DeletedBy: "yours"},
+		{Path: "dir/d.txt", Count: 1, DeletedBy: "yours"},
+	}
+	if ! reflect.DeepEqual(conflicts, want) {
+		t.Errorf("got conflicts %+v, want %+v", conflicts, want)
+	}
+	final := readTestTree(t, finalPath)
+	if _, ok := final["b.txt"]; ok {
+		t.Error("a file deleted since the older snapshot is back without asking")
+	}
+	if final["c.txt"] != "c\n" {
+		t.Errorf("c.txt is %q in merging_final", final["c.txt"])
+	}
+	fromOther := readTestTree(t, fromOtherPath)
+	if fromOther["b.txt"] != "b\n" || fromOther["dir/d.txt"] != "d\n" {
+		t.Errorf("merging_other has %v, want the deleted files", fromOther)
+	}
+}
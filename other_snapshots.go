@@ -9,11 +9,6 @@ import (
 	"time"
 	"encoding/json"
 	"strings"
-  "cloud.google.com/go/storage"
-	"context"
-  "google.golang.org/api/option"
-  "google.golang.org/api/iterator"
-	archiver "github.com/mholt/archiver/v3"
   "os"
   "github.com/otiai10/copy"
   
@@ -25,7 +20,6 @@ func viewOthersSnapshots(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	projectName := vars["proj"]
 	otherEmail := vars["email"]
-	rootPath, _ := GetRootPath()
 
 	pd, err := getProjectData(projectName)
 	if err != nil {
@@ -37,9 +31,13 @@ func viewOthersSnapshots(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, err)
 		return
 	}
-	sakPath := filepath.Join(rootPath, pd["sak_json"])
+	store, err := getStore(pd)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
 
-	manifestStatus, err := doesGCPPathExists(pd["project_name"], sakPath, otherEmail + "/manifest.json")
+	manifestStatus, err := store.Exists(otherEmail + "/manifest.json")
 	if err != nil {
 		errorPage(w, err)
 		return
@@ -51,57 +49,47 @@ func viewOthersSnapshots(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hasSnapshots := false
-	snapshots := make([]map[string]string, 0)
-	if manifestStatus {
-		manifestRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, otherEmail + "/manifest.json")
-		if err != nil {
-			errorPage(w, err)
-			return
-		}
+	snapshots, err := getManifest(store, otherEmail)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	hasSnapshots := manifestStatus
 
-		err = json.Unmarshal(manifestRaw, &snapshots)
-		if err != nil {
-			errorPage(w, errors.Wrap(err, "json error"))
-			return
+	// mark the snapshots whose work is already in the user's latest snapshot.
+	inYours := make(map[string]bool)
+	graph, err := getHistoryGraph(store)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	mySnapshots, err := getManifest(store, userData.Email)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	yourLatest := ""
+	if len(mySnapshots) > 0 {
+		yourLatest = mySnapshots[0].Name
+		for ref := range graph.ancestors(SnapshotRef{userData.Email, mySnapshots[0].Name}) {
+			if ref.Email == otherEmail {
+				inYours[ref.Name] = true
+			}
 		}
-		hasSnapshots = true
 	}
 
-	ctx := context.Background()
-  client, err := storage.NewClient(ctx, option.WithCredentialsFile(sakPath))
+  users, err := getTeamMembers(store, userData.Email)
   if err != nil {
-    errorPage(w, errors.Wrap(err, "storage error"))
+    errorPage(w, err)
     return
   }
-  defer client.Close()
-
-  users := make([]string, 0)
-  it := client.Bucket(pd["gcp_bucket"]).Objects(ctx, &storage.Query{Prefix: "users/"})
-  for {
-    attrs, err := it.Next()
-    if err == iterator.Done {
-      break
-    }
-    if err != nil {
-      errorPage(w, errors.Wrap(err, "storage error"))
-    	return
-    }
-    if attrs.Name != "users/" {
-    	s := strings.ReplaceAll(attrs.Name, "users/", "")
-    	if s == userData["email"] {
-    		continue
-    	}
-    	users = append(users, s)
-    }
-  }
 
-	otherUserDataRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, "users/" + otherEmail)
+	otherUserDataRaw, err := store.Get("users/" + otherEmail)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	otherUserData := make(map[string]string)
+	var otherUserData UserProfile
 	err = json.Unmarshal(otherUserDataRaw, &otherUserData)
 	if err != nil {
 		errorPage(w, errors.Wrap(err, "json error"))
@@ -111,13 +99,16 @@ func viewOthersSnapshots(w http.ResponseWriter, r *http.Request) {
 	type Context struct {
 		Projects []string
 		CurrentProject string
-		Snapshots []map[string]string
+		Snapshots []Snapshot
 		SnapshotTime func(s string) string
 		CleanSnapshotDesc func(s string) template.HTML
 		Users []string
 		OtherName string
 		OtherEmail string
 		HasSnapshots bool
+		InYours map[string]bool
+		Email string
+		YourLatest string
 	}
 
 	st := func(s string) string {
@@ -136,7 +127,7 @@ func viewOthersSnapshots(w http.ResponseWriter, r *http.Request) {
 
 	tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/view_others_snapshots.html"))
   tmpl.Execute(w, Context{projects, projectName, snapshots, st, csd, users, 
-  	otherUserData["fullname"], otherEmail, hasSnapshots})
+  	otherUserData.FullName, otherEmail, hasSnapshots, inYours, userData.Email, yourLatest})
 }
 
 
@@ -145,7 +136,6 @@ func viewOthersSnapshot(w http.ResponseWriter, r *http.Request) {
 	projectName := vars["proj"]
 	otherEmail := vars["email"]
 	snapshotName := vars["sname"]
-	rootPath, _ := GetRootPath()
 
 	pd, err := getProjectData(projectName)
 	if err != nil {
@@ -153,52 +143,36 @@ func viewOthersSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sakPath := filepath.Join(rootPath, pd["sak_json"])
-
-	manifestRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, otherEmail + "/manifest.json")
+	store, err := getStore(pd)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	projects, err := getAllProjects()
+
+	snapshots, err := getManifest(store, otherEmail)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-
-	snapshots := make([]map[string]string, 0)
-	err = json.Unmarshal(manifestRaw, &snapshots)
+	projects, err := getAllProjects()
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "json error"))
+		errorPage(w, err)
 		return
 	}
 
-	var snapshotDesc string
-	for _, snapshotObj := range snapshots {
-		if snapshotObj["snapshot_name"] == snapshotName {
-			snapshotDesc = snapshotObj["snapshot_desc"]
-		}
+	snapshotObj := findSnapshot(snapshots, snapshotName)
+	if snapshotObj == nil {
+		errorPage(w, errors.New("The snapshot " + snapshotName + " does not exist."))
+		return
 	}
+	snapshotDesc := snapshotObj.Desc
 
-	snapshotRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, otherEmail + "/" + snapshotName + ".tar.gz")
+	snapshotUndoPath, release, err := getCachedSnapshot(store, projectName, otherEmail, snapshotName, snapshotObj.Hash)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	snapshotPath := filepath.Join(rootPath, "flotmp", projectName, snapshotName + ".tar.gz")
-	os.MkdirAll(filepath.Join(rootPath, "flotmp", projectName), 0777)
-	err = os.WriteFile(snapshotPath, snapshotRaw, 0777)	
-	if err != nil {
-		errorPage(w, errors.Wrap(err, "os error"))
-		return
-	}
-	snapshotUndoPath := filepath.Join(rootPath, "flotmp", projectName, snapshotName)
-	os.RemoveAll(snapshotUndoPath)
-	err = archiver.Unarchive(snapshotPath, snapshotUndoPath)
-	if err != nil {
-		errorPage(w, errors.Wrap(err, "archiver error"))
-		return
-	}
+	defer release()
 
 	filesInSnapshot := make(map[string]string)
 	oldObjList, err := getAllFilesList(snapshotUndoPath)
@@ -219,6 +193,7 @@ func viewOthersSnapshot(w http.ResponseWriter, r *http.Request) {
 		SnapshotDesc template.HTML
 		FilesInSnapshot map[string]string
 		SnapshotPath string
+		Email string
 	}
 
 	st := func(s string) string {
@@ -237,7 +212,7 @@ func viewOthersSnapshot(w http.ResponseWriter, r *http.Request) {
 
 	tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/view_snapshot.html"))
   tmpl.Execute(w, Context{projects, projectName, snapshotName, st(snapshotName), csd(snapshotDesc),
-  	filesInSnapshot, snapshotUndoPath})
+  	filesInSnapshot, snapshotUndoPath, otherEmail})
 }
 
 
@@ -258,27 +233,30 @@ func startFromThis(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, err)
 		return
 	}
-	sakPath := filepath.Join(rootPath, pd["sak_json"])
-
-	// download and replace path
-	snapshotRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, otherEmail + "/" + snapshotName + ".tar.gz")
+	store, err := getStore(pd)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	snapshotPath := filepath.Join(rootPath, "flotmp", projectName, snapshotName + ".tar.gz")
-	os.MkdirAll(filepath.Join(rootPath, "flotmp", projectName), 0777)
-	err = os.WriteFile(snapshotPath, snapshotRaw, 0777)	
+
+	otherSnapshots, err := getManifest(store, otherEmail)
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "os error"))
+		errorPage(w, err)
+		return
+	}
+	snapshotObj := findSnapshot(otherSnapshots, snapshotName)
+	if snapshotObj == nil {
+		errorPage(w, errors.New("The snapshot " + snapshotName + " does not exist."))
 		return
 	}
-	snapshotUndoPath := filepath.Join(rootPath, "flotmp", projectName, snapshotName)
-	err = archiver.Unarchive(snapshotPath, snapshotUndoPath)
+
+	// download and replace path
+	snapshotUndoPath, release, err := getCachedSnapshot(store, projectName, otherEmail, snapshotName, snapshotObj.Hash)
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "archiver error"))
+		errorPage(w, err)
 		return
 	}
+	defer release()
 
 	snapshotObjFIs, err := os.ReadDir(snapshotUndoPath)
 	if err != nil {
@@ -293,9 +271,12 @@ func startFromThis(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// upload snapshot object
-	newSnapshotName := time.Now().Format(VersionFormat)
+	snapshot := newSnapshot(userData, snapshotObj.Desc)
+	snapshot.Origin = &SnapshotOrigin{OriginStartFrom, SnapshotRef{otherEmail, snapshotName}}
+	snapshot.Parents = []SnapshotRef{snapshot.Origin.From}
+	snapshot.FileCount, snapshot.Hash, snapshot.Size = snapshotObj.FileCount, snapshotObj.Hash, snapshotObj.Size
 
-  err = uploadFile(pd["gcp_bucket"], sakPath, userData["email"] + "/" + newSnapshotName + ".tar.gz", snapshotRaw)
+  err = copySnapshot(store, otherEmail, snapshotName, userData.Email, snapshot.Name)
   if err != nil {
   	errorPage(w, errors.Wrap(err, "storage error"))
   	return
@@ -303,84 +284,11 @@ func startFromThis(w http.ResponseWriter, r *http.Request) {
 
 
 	// update manifest
-	manifestRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, otherEmail + "/manifest.json")
-	if err != nil {
-		errorPage(w, err)
-		return
-	}
-
-	snapshots := make([]map[string]string, 0)
-	err = json.Unmarshal(manifestRaw, &snapshots)
-	if err != nil {
-		errorPage(w, errors.Wrap(err, "json error"))
-		return
-	}
-
-	var snapshotDesc string
-	for _, snapshotObj := range snapshots {
-		if snapshotObj["snapshot_name"] == snapshotName {
-			snapshotDesc = snapshotObj["snapshot_desc"]
-		}
-	}
-
-	manifestStatus, err := doesGCPPathExists(pd["project_name"], sakPath, userData["email"] + "/manifest.json")
-	if err != nil {
-		errorPage(w, err)
-		return
-	}
-
-	manifestObj := make([]map[string]string, 0)
-	if manifestStatus {
-
-		manifestRaw, err := downloadFileAsBytes(pd["gcp_bucket"], sakPath, userData["email"] + "/manifest.json")
-		if err != nil {
-			errorPage(w, err)
-			return
-		}
-		err = json.Unmarshal(manifestRaw, &manifestObj)
-		if err != nil {
-			errorPage(w, errors.Wrap(err, "json error"))
-			return
-		}
-
-		aManifestObj := map[string]string {
-			"snapshot_name": newSnapshotName,
-			"snapshot_desc": snapshotDesc + "\n\nThis snapshot was loaded from " + otherEmail,
-		}
-		newManifestObj := append([]map[string]string{aManifestObj}, snapshots...)
-
-		jsonBytes, err := json.Marshal(newManifestObj)
-	  if err != nil {
-	  	errorPage(w, errors.Wrap(err, "json error"))
-	  	return
-	  }
-	  err = uploadFile(pd["gcp_bucket"], sakPath, userData["email"] + "/manifest.json", jsonBytes)
-	  if err != nil {
-	  	errorPage(w, errors.Wrap(err, "storage error"))
-	  	return
-	  }
-
-	} else {
-
-		manifestObj := []map[string]string {
-	  	{
-	  		"snapshot_name": newSnapshotName,
-	  		"snapshot_desc": snapshotDesc + "\n\nThis snapshot was loaded from " + otherEmail,
-	  	},
-	  }
-
-	  jsonBytes, err := json.Marshal(manifestObj)
-	  if err != nil {
-	  	errorPage(w, errors.Wrap(err, "json error"))
-	  	return
-	  }
-	  err = uploadFile(pd["gcp_bucket"], sakPath, userData["email"] + "/manifest.json", jsonBytes)
-	  if err != nil {
-	  	errorPage(w, errors.Wrap(err, "storage error"))
-	  	return
-	  }
-
-	}
+  err = updateManifest(store, userData.Email, addSnapshotEntry(snapshot))
+  if err != nil {
+  	errorPage(w, err)
+  	return
+  }
 
   http.Redirect(w, r, "/view_snapshots/" + projectName, 307)		  
 }
\ No newline at end of file
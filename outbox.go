@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+// Snapshots made while the storage cannot be reached wait in
+// <root>/outbox/<project> as <snapshot>.tar.gz with the manifest entry in
+// <snapshot>.json. They are uploaded oldest first once the storage is back.
+
+var outboxMutex sync.Mutex
+
+
+// isOfflineError reports if an error came from not reaching the storage at all,
+// as opposed to the storage refusing a request.
+func isOfflineError(err error) bool {
+	if errors.Is(err, ErrStoreUnreachable) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+
+func getOutboxPath(projectName string) string {
+	rootPath, _ := GetRootPath()
+	return filepath.Join(rootPath, "outbox", projectName)
+}
+
+
+// queueSnapshot saves a snapshot of the files (absolute paths under basePath) to
+// the project's outbox.
+func queueSnapshot(projectName string, snapshot Snapshot, basePath string, files []string) error {
+	outboxPath := getOutboxPath(projectName)
+	err := os.MkdirAll(outboxPath, 0777)
+	if err != nil {
+		return errors.Wrap(err, "os error")
+	}
+	snapshotName := snapshot.Name
+
+	archivePath := filepath.Join(outboxPath, snapshotName + ".tar.gz")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return errors.Wrap(err, "os error")
+	}
+	err = writeSnapshotArchive(f, basePath, files)
+	f.Close()
+	if err != nil {
+		os.Remove(archivePath)
+		return err
+	}
+
+	// the entry is written last. An archive without one is an unfinished queueing.
+	jsonBytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return errors.Wrap(err, "json error")
+	}
+	err = os.WriteFile(filepath.Join(outboxPath, snapshotName + ".json"), jsonBytes, 0777)
+	if err != nil {
+		return errors.Wrap(err, "os error")
+	}
+	return nil
+}
+
+
+// getPendingSnapshots returns the manifest entries waiting in a project's outbox,
+// newest first like a manifest.
+func getPendingSnapshots(projectName string) ([]Snapshot, error) {
+	pending := make([]Snapshot, 0)
+	outboxPath := getOutboxPath(projectName)
+	if ! DoesPathExists(outboxPath) {
+		return pending, nil
+	}
+
+	dirFIs, err := os.ReadDir(outboxPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "os error")
+	}
+	for _, dirFI := range dirFIs {
+		if ! strings.HasSuffix(dirFI.Name(), ".json") {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(outboxPath, dirFI.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, "os error")
+		}
+		var snapshot Snapshot
+		err = json.Unmarshal(raw, &snapshot)
+		if err != nil {
+			return nil, errors.Wrap(err, "json error")
+		}
+		pending = append(pending, snapshot)
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return snapshotTimeBefore(pending[j].Name, pending[i].Name)
+	})
+	return pending, nil
+}
+
+
+func snapshotTimeBefore(a, b string) bool {
+	aTime, errA := time.Parse(VersionFormat, a)
+	bTime, errB := time.Parse(VersionFormat, b)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	return aTime.Before(bTime)
+}
+
+
+// insertSnapshotEntry returns an edit for updateManifest that puts a snapshot made
+// earlier in its place by time, since snapshots may have been saved from another
+// machine while this one was offline. Its parent is the snapshot before it.
+func insertSnapshotEntry(snapshot Snapshot) func([]Snapshot) ([]Snapshot, error) {
+	return func(snapshots []Snapshot) ([]Snapshot, error) {
+		if findSnapshot(snapshots, snapshot.Name) != nil {
+			// an earlier sync got this far before stopping.
+			return snapshots, nil
+		}
+		index := len(snapshots)
+		for i := range snapshots {
+			if snapshotTimeBefore(snapshots[i].Name, snapshot.Name) {
+				index = i
+				break
+			}
+		}
+		if index < len(snapshots) {
+			snapshot.Parents = []SnapshotRef{{snapshot.AuthorEmail, snapshots[index].Name}}
+		}
+		newSnapshots := append([]Snapshot{}, snapshots[: index]...)
+		newSnapshots = append(newSnapshots, snapshot)
+		return append(newSnapshots, snapshots[index :]...), nil
+	}
+}
+
+
+// syncOutbox uploads a project's pending snapshots oldest first, stopping at the
+// first failure so the order is kept.
+func syncOutbox(store Store, projectName, email string) error {
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+
+	pending, err := getPendingSnapshots(projectName)
+	if err != nil {
+		return err
+	}
+	rootPath, _ := GetRootPath()
+	outboxPath := getOutboxPath(projectName)
+
+	for i := len(pending) - 1; i >= 0; i-- {
+		snapshot := pending[i]
+		snapshotName := snapshot.Name
+		archivePath := filepath.Join(outboxPath, snapshotName + ".tar.gz")
+
+		unpackPath := filepath.Join(rootPath, "flotmp", UntestedRandomString(10))
+		f, err := os.Open(archivePath)
+		if err != nil {
+			return errors.Wrap(err, "os error")
+		}
+		err = extractSnapshotArchive(f, unpackPath)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		files, err := getAllFilesList(unpackPath)
+		if err != nil {
+			return err
+		}
+
+		snapshot.Hash, snapshot.Size, err = uploadSnapshotTree(store, email, snapshotName, unpackPath, files)
+		os.RemoveAll(unpackPath)
+		if err != nil {
+			return err
+		}
+		snapshot.FileCount = len(files)
+
+		err = updateManifest(store, email, insertSnapshotEntry(snapshot))
+		if err != nil {
+			return err
+		}
+
+		os.Remove(filepath.Join(outboxPath, snapshotName + ".json"))
+		os.Remove(archivePath)
+	}
+	return nil
+}
+
+
+// syncOutboxInBackground starts syncOutbox for a project that has pending
+// snapshots without waiting for it, so pages do not wait on the uploads. A failed
+// sync leaves the snapshots pending for the next try.
+func syncOutboxInBackground(store Store, projectName, email string) {
+	pending, err := getPendingSnapshots(projectName)
+	if err != nil || len(pending) == 0 {
+		return
+	}
+	go func() {
+		err := syncOutbox(store, projectName, email)
+		if err != nil && ! isOfflineError(err) {
+			fmt.Printf("%+v\n", err)
+		}
+	}()
+}
+
+
+// unpackPendingSnapshot returns a folder with the files of a pending snapshot. The
+// archives never change, so each is unpacked once into flotmp and kept there for
+// the links of the pages that show it. The archive is gone once the snapshot is
+// uploaded, which gives an error that is os.ErrNotExist.
+func unpackPendingSnapshot(projectName, snapshotName string) (string, error) {
+	rootPath, _ := GetRootPath()
+	unpackPath := filepath.Join(rootPath, "flotmp", "outbox", projectName, snapshotName)
+	if DoesPathExists(unpackPath) {
+		return unpackPath, nil
+	}
+
+	f, err := os.Open(filepath.Join(getOutboxPath(projectName), snapshotName + ".tar.gz"))
+	if err != nil {
+		return "", errors.Wrap(err, "os error")
+	}
+	defer f.Close()
+	tmpPath := filepath.Join(rootPath, "flotmp", UntestedRandomString(10))
+	err = extractSnapshotArchive(f, tmpPath)
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return "", err
+	}
+
+	os.MkdirAll(filepath.Dir(unpackPath), 0777)
+	err = os.Rename(tmpPath, unpackPath)
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		// another request unpacked it first.
+		if DoesPathExists(unpackPath) {
+			return unpackPath, nil
+		}
+		return "", errors.Wrap(err, "os error")
+	}
+	return unpackPath, nil
+}
+
+
+// syncAllOutboxes tries every project's outbox. It runs in the background.
+func syncAllOutboxes() {
+	rootPath, _ := GetRootPath()
+	dirFIs, err := os.ReadDir(filepath.Join(rootPath, "outbox"))
+	if err != nil {
+		return
+	}
+	userData, err := getUserData()
+	if err != nil {
+		return
+	}
+
+	for _, dirFI := range dirFIs {
+		pd, err := getProjectData(dirFI.Name())
+		if err != nil {
+			continue
+		}
+		store, err := getStore(pd)
+		if err != nil {
+			continue
+		}
+		err = syncOutbox(store, dirFI.Name(), userData.Email)
+		if err != nil && ! isOfflineError(err) {
+			fmt.Printf("%+v\n", err)
+		}
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"path/filepath"
 	"os"
 	"github.com/pkg/errors"
-	// "strings"
+	"strings"
 	"encoding/json"
 	"github.com/gorilla/mux"
 	// "fmt"
@@ -27,7 +27,7 @@ func newProject(w http.ResponseWriter, r *http.Request) {
 
 	files := make([]string, 0)
 	for _, dirFI := range dirFIs {
-		if ! dirFI.IsDir() && dirFI.Name() != "user_data.json" {
+		if ! dirFI.IsDir() && dirFI.Name() != "user_data.json" && dirFI.Name() != "settings.json" {
 			files = append(files, dirFI.Name())
 		}
 	}
@@ -53,63 +53,100 @@ func saveProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	projectData := map[string]string {
-		"project_name": r.FormValue("project_name"),
-		"gcp_bucket": r.FormValue("gcp_bucket"),
-		"sak_json": r.FormValue("sak_json"),
+	projectData := getProjectDataFromForm(r)
+	if r.FormValue("encrypt") == "on" {
+		projectData.EncKey, err = newProjectKey()
+		if err != nil {
+			errorPage(w, err)
+			return
+		}
+	}
+	if projectData.Backend == "local" && filepath.IsAbs(projectData.DirPath) {
+		// a missing directory is otherwise taken as the storage being offline.
+		err = os.MkdirAll(projectData.DirPath, 0777)
+		if err != nil {
+			errorPage(w, errors.Wrap(err, "os error"))
+			return
+		}
 	}
 
-	sakPath := filepath.Join(rootPath, projectData["sak_json"])
-	descMDStatus, err := doesGCPPathExists(projectData["gcp_bucket"], sakPath, "desc.md")
+	store, err := getStore(projectData)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	creatorJSONStatus, err := doesGCPPathExists(projectData["gcp_bucket"], sakPath, "creator.json")
+	descMDStatus, err := store.Exists("desc.md")
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-
-	if descMDStatus && creatorJSONStatus {
-		errorPage(w, errors.New("Use join project. Because this project is already existing."))
+	creatorJSONStatus, err := store.Exists("creator.json")
+	if err != nil {
+		errorPage(w, err)
 		return
 	}
 
-	jsonBytes, err := json.Marshal(projectData)
-	if err != nil {
-		errorPage(w, errors.Wrap(err, "json error"))
+	if descMDStatus && creatorJSONStatus {
+		errorPage(w, errors.New("Use join project. Because this project is already existing."))
 		return
 	}
 
-	err = os.WriteFile(filepath.Join(rootPath, "pd", projectData["project_name"] + ".json"), jsonBytes, 0777)
+	err = writeProjectData(projectData)
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "os write error"))
+		errorPage(w, err)
 		return
 	}
 
-	err = uploadFile(projectData["gcp_bucket"], sakPath, "desc.md", []byte(r.FormValue("desc")))
+	err = store.Put("desc.md", []byte(r.FormValue("desc")))
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
 
 	jsonBytes2, err := json.Marshal(userData)
-	err = uploadFile(projectData["gcp_bucket"], sakPath, "users/" + userData["email"], jsonBytes2)
+	err = store.Put("users/" + userData.Email, jsonBytes2)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
 	// upload the email of he who started the project, only him would be able to release.
-	err = uploadFile(projectData["gcp_bucket"], sakPath, "creator.json", jsonBytes2)
+	err = store.Put("creator.json", jsonBytes2)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
 
-	os.MkdirAll(filepath.Join(rootPath, "p", projectData["project_name"]), 0777)
+	os.MkdirAll(filepath.Join(rootPath, "p", projectData.ProjectName), 0777)
 
-	http.Redirect(w, r, "/view_project/" + projectData["project_name"], 307)
+	http.Redirect(w, r, "/view_project/" + projectData.ProjectName, 307)
+}
+
+
+// getProjectDataFromForm reads the storage fields shared by the new project and
+// join project forms.
+func getProjectDataFromForm(r *http.Request) ProjectConfig {
+	projectData := ProjectConfig{
+		ProjectName: r.FormValue("project_name"),
+		Backend: r.FormValue("backend"),
+		EncKey: strings.TrimSpace(r.FormValue("enc_key")),
+	}
+
+	switch projectData.Backend {
+	case "local":
+		projectData.DirPath = strings.TrimSpace(r.FormValue("dir_path"))
+	case "s3":
+		projectData.S3Endpoint = strings.TrimSpace(r.FormValue("s3_endpoint"))
+		projectData.S3Bucket = r.FormValue("s3_bucket")
+		projectData.S3AccessKey = r.FormValue("s3_access_key")
+		projectData.S3SecretKey = r.FormValue("s3_secret_key")
+		projectData.S3Region = r.FormValue("s3_region")
+		projectData.S3PathStyle = r.FormValue("s3_path_style") == "on"
+	default:
+		projectData.Backend = "gcs"
+		projectData.GCPBucket = r.FormValue("gcp_bucket")
+		projectData.SAKJSON = r.FormValue("sak_json")
+	}
+	return projectData
 }
 
 
@@ -125,7 +162,7 @@ func joinProject(w http.ResponseWriter, r *http.Request) {
 
 	files := make([]string, 0)
 	for _, dirFI := range dirFIs {
-		if ! dirFI.IsDir() && dirFI.Name() != "user_data.json" {
+		if ! dirFI.IsDir() && dirFI.Name() != "user_data.json" && dirFI.Name() != "settings.json" {
 			files = append(files, dirFI.Name())
 		}
 	}
@@ -151,19 +188,19 @@ func endJoinProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	projectData := map[string]string {
-		"project_name": r.FormValue("project_name"),
-		"gcp_bucket": r.FormValue("gcp_bucket"),
-		"sak_json": r.FormValue("sak_json"),
-	}
+	projectData := getProjectDataFromForm(r)
 
-	sakPath := filepath.Join(rootPath, projectData["sak_json"])
-	descMDStatus, err := doesGCPPathExists(projectData["gcp_bucket"], sakPath, "desc.md")
+	store, err := getStore(projectData)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	creatorJSONStatus, err := doesGCPPathExists(projectData["gcp_bucket"], sakPath, "creator.json")
+	descMDStatus, err := store.Exists("desc.md")
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	creatorJSONStatus, err := store.Exists("creator.json")
 	if err != nil {
 		errorPage(w, err)
 		return
@@ -174,46 +211,74 @@ func endJoinProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-
-	jsonBytes, err := json.Marshal(projectData)
+	backendStore, err := getBackendStore(projectData)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	checkName := "desc.md"
+	if ! descMDStatus {
+		checkName = "creator.json"
+	}
+	encryptedStatus, err := isEncryptedObject(backendStore, checkName)
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "json error"))
+		errorPage(w, err)
+		return
+	}
+	if encryptedStatus && projectData.EncKey == "" {
+		errorPage(w, errors.New("This project is encrypted. Ask a member of the project for the project key."))
+		return
+	}
+	if ! encryptedStatus && projectData.EncKey != "" {
+		errorPage(w, errors.New("This project is not encrypted. Leave the project key empty."))
 		return
 	}
+	// a wrong key fails here
+	if encryptedStatus {
+		_, err = store.Get(checkName)
+		if err != nil {
+			errorPage(w, err)
+			return
+		}
+	}
+
 
-	err = os.WriteFile(filepath.Join(rootPath, "pd", projectData["project_name"] + ".json"), jsonBytes, 0777)
+	err = writeProjectData(projectData)
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "os write error"))
+		errorPage(w, err)
 		return
 	}
 
 
 	jsonBytes2, err := json.Marshal(userData)
-	err = uploadFile(projectData["gcp_bucket"], sakPath, "users/" + userData["email"], jsonBytes2)
+	err = store.Put("users/" + userData.Email, jsonBytes2)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
 
-	os.MkdirAll(filepath.Join(rootPath, "p", projectData["project_name"]), 0777)
+	os.MkdirAll(filepath.Join(rootPath, "p", projectData.ProjectName), 0777)
 
-	http.Redirect(w, r, "/view_project/" + projectData["project_name"], 307)
+	http.Redirect(w, r, "/view_project/" + projectData.ProjectName, 307)
 }
 
 
 func viewProject(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	projectName := vars["proj"]
-	rootPath, _ := GetRootPath()
 
 	pd, err := getProjectData(projectName)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	sakPath := filepath.Join(rootPath, pd["sak_json"])
+	store, err := getStore(pd)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
 
-	descBytes, err := downloadFileAsBytes(pd["project_name"], sakPath, "desc.md")
+	descBytes, err := store.Get("desc.md")
 	if err != nil {
 		errorPage(w, err)
 		return
@@ -229,25 +294,29 @@ func viewProject(w http.ResponseWriter, r *http.Request) {
 		Projects []string
 		CurrentProject string
 		DescHTML template.HTML
+		ProjectKey string
 	}
 
 	tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/view_project.html"))
-  tmpl.Execute(w, Context{projects, projectName, template.HTML(html)})
+  tmpl.Execute(w, Context{projects, projectName, template.HTML(html), pd.EncKey})
 }
 
 
 func updateDesc(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	projectName := vars["proj"]
-	rootPath, _ := GetRootPath()
 
 	pd, err := getProjectData(projectName)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	sakPath := filepath.Join(rootPath, pd["sak_json"])
-	descBytes, err := downloadFileAsBytes(pd["project_name"], sakPath, "desc.md")
+	store, err := getStore(pd)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	descBytes, err := store.Get("desc.md")
 	if err != nil {
 		errorPage(w, err)
 		return
@@ -261,7 +330,7 @@ func updateDesc(w http.ResponseWriter, r *http.Request) {
 		tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/update_desc.html"))
 	  tmpl.Execute(w, Context{projectName, string(descBytes)})
 	} else {
-		err = uploadFile(pd["gcp_bucket"], sakPath, "desc.md", []byte(r.FormValue("desc")))
+		err = store.Put("desc.md", []byte(r.FormValue("desc")))
 		if err != nil {
 			errorPage(w, err)
 			return
@@ -287,10 +356,14 @@ func updateExclusionRules(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, err)
 		return
 	}
-	sakPath := filepath.Join(rootPath, pd["sak_json"])
+	store, err := getStore(pd)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
 
 	if r.Method == http.MethodGet {
-		rulesStatus, err := doesGCPPathExists(pd["project_name"], sakPath, userData["email"] + "/exrules.txt")
+		rulesStatus, err := store.Exists(userData.Email + "/exrules.txt")
 		if err != nil {
 			errorPage(w, err)
 			return
@@ -298,7 +371,7 @@ func updateExclusionRules(w http.ResponseWriter, r *http.Request) {
 
 		var rules string
 		if rulesStatus {
-			rulesBytes, err := downloadFileAsBytes(pd["project_name"], sakPath, userData["email"] + "/exrules.txt")
+			rulesBytes, err := store.Get(userData.Email + "/exrules.txt")
 			if err != nil {
 				errorPage(w, err)
 				return
@@ -314,7 +387,7 @@ func updateExclusionRules(w http.ResponseWriter, r *http.Request) {
 	  tmpl.Execute(w, Context{projectName, rules})
 	} else {
 
-		err = uploadFile(pd["gcp_bucket"], sakPath, userData["email"] + "/exrules.txt", []byte(r.FormValue("exrules")))
+		err = store.Put(userData.Email + "/exrules.txt", []byte(r.FormValue("exrules")))
 		if err != nil {
 			errorPage(w, err)
 			return
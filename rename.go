@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+
+// A file that is deleted in one version and added in the next is taken as moved
+// when the two are at least this similar, in percent of lines in common. It can
+// be changed with the rename_threshold setting; 100 only finds unchanged files.
+const DefaultRenameThreshold = 50
+
+// Looking for similar files compares every deleted file with every added one, so
+// it is skipped when there are more than this many of either, and files bigger
+// than maxRenameFileSize are only paired when unchanged.
+const (
+	maxRenameCandidates = 200
+	maxRenameFileSize = 1024 * 1024
+)
+
+// RenamedFile is a file moved from OldPath to NewPath, with the similarity of
+// its two versions in percent.
+type RenamedFile struct {
+	OldPath string
+	NewPath string
+	Similarity int
+}
+
+
+func getRenameThreshold() int {
+	settings, err := getSettings()
+	if err != nil {
+		return DefaultRenameThreshold
+	}
+	threshold, err := strconv.Atoi(settings["rename_threshold"])
+	if err != nil || threshold < 1 || threshold > 100 {
+		return DefaultRenameThreshold
+	}
+	return threshold
+}
+
+
+// similarity returns how alike two versions of a file are in percent: the share
+// of lines they have in common for text, and 100 or 0 for anything else.
+func similarity(a, b []byte) int {
+	if bytes.Equal(a, b) {
+		return 100
+	}
+	if ! isTextFile(a) || ! isTextFile(b) {
+		return 0
+	}
+	aLines, bLines := splitLines(string(a)), splitLines(string(b))
+	common := 0
+	for _, j := range lineMatches(aLines, bLines) {
+		if j != -1 {
+			common += 1
+		}
+	}
+	return 200 * common / (len(aLines) + len(bLines))
+}
+
+
+// findRenames pairs deleted files (short paths under oldDir) with added files
+// (short paths under newDir) that are at least threshold percent alike. Unchanged files are paired
+// first, then the most alike pairs.
+func findRenames(oldDir string, deleted []string, newDir string, added []string, threshold int) ([]RenamedFile, error) {
+	renames := make([]RenamedFile, 0)
+	if len(deleted) == 0 || len(added) == 0 {
+		return renames, nil
+	}
+
+	hashAll := func(dir string, shortPaths []string) ([]string, error) {
+		hashes := make([]string, len(shortPaths))
+		for i, shortPath := range shortPaths {
+			hash, _, err := hashFileChunks(filepath.Join(dir, shortPath))
+			if err != nil {
+				return nil, err
+			}
+			hashes[i] = hash
+		}
+		return hashes, nil
+	}
+	oldHashes, err := hashAll(oldDir, deleted)
+	if err != nil {
+		return nil, err
+	}
+	newHashes, err := hashAll(newDir, added)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]RenamedFile, 0)
+	// unchanged files are found by their hash.
+	deletedByHash := make(map[string][]string)
+	for i, shortPath := range deleted {
+		deletedByHash[oldHashes[i]] = append(deletedByHash[oldHashes[i]], shortPath)
+	}
+	emptyHash := hashBytes(nil)
+	for j, shortPath := range added {
+		if newHashes[j] == emptyHash {
+			// empty files are all alike.
+			continue
+		}
+		for _, oldPath := range deletedByHash[newHashes[j]] {
+			candidates = append(candidates, RenamedFile{oldPath, shortPath, 100})
+		}
+	}
+
+	if threshold < 100 && len(deleted) <= maxRenameCandidates && len(added) <= maxRenameCandidates {
+		readSmall := func(dir string, shortPaths []string) ([][]byte, error) {
+			contents := make([][]byte, len(shortPaths))
+			for i, shortPath := range shortPaths {
+				fi, err := os.Stat(filepath.Join(dir, shortPath))
+				if err != nil {
+					return nil, errors.Wrap(err, "os error")
+				}
+				if fi.Size() > maxRenameFileSize {
+					continue
+				}
+				contents[i], _, err = readMergeFile(dir, shortPath)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return contents, nil
+		}
+		oldContents, err := readSmall(oldDir, deleted)
+		if err != nil {
+			return nil, err
+		}
+		newContents, err := readSmall(newDir, added)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range deleted {
+			for j := range added {
+				if oldHashes[i] == newHashes[j] || oldContents[i] == nil || newContents[j] == nil {
+					continue
+				}
+				// sizes far apart cannot reach the threshold.
+				small, big := len(oldContents[i]), len(newContents[j])
+				if small > big {
+					small, big = big, small
+				}
+				if 200 * small / (small + big + 1) < threshold {
+					continue
+				}
+				score := similarity(oldContents[i], newContents[j])
+				if score >= threshold {
+					candidates = append(candidates, RenamedFile{deleted[i], added[j], score})
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(a, b int) bool {
+		return candidates[a].Similarity > candidates[b].Similarity
+	})
+	usedOld := make(map[string]bool)
+	usedNew := make(map[string]bool)
+	for _, candidate := range candidates {
+		if usedOld[candidate.OldPath] || usedNew[candidate.NewPath] {
+			continue
+		}
+		usedOld[candidate.OldPath] = true
+		usedNew[candidate.NewPath] = true
+		renames = append(renames, candidate)
+	}
+	sort.Slice(renames, func(a, b int) bool {
+		return renames[a].NewPath < renames[b].NewPath
+	})
+	return renames, nil
+}
+
+
+// mergeRenames finds the files a merge should follow to a new name: files one side
+// renamed while the other kept them under the old name, and files both sides
+// renamed alike. It returns the names of each such file in base, yours and other
+// by its new name. Files the two sides renamed differently are not followed, so
+// both new names are kept.
+func mergeRenames(basePath, yoursPath, otherPath string) (map[string][3]string, error) {
+	listShort := func(dirPath string) (map[string]bool, error) {
+		files, err := getAllFilesList(dirPath)
+		if err != nil {
+			return nil, err
+		}
+		shortPaths := make(map[string]bool)
+		for _, p := range files {
+			shortPaths[strings.Replace(p, dirPath + "/", "", 1)] = true
+		}
+		return shortPaths, nil
+	}
+	inBase, err := listShort(basePath)
+	if err != nil {
+		return nil, err
+	}
+	inYours, err := listShort(yoursPath)
+	if err != nil {
+		return nil, err
+	}
+	inOther, err := listShort(otherPath)
+	if err != nil {
+		return nil, err
+	}
+
+	renamesOf := func(sidePath string, inSide map[string]bool) (map[string]string, error) {
+		deleted := make([]string, 0)
+		added := make([]string, 0)
+		for shortPath := range inBase {
+			if ! inSide[shortPath] {
+				deleted = append(deleted, shortPath)
+			}
+		}
+		for shortPath := range inSide {
+			if ! inBase[shortPath] {
+				added = append(added, shortPath)
+			}
+		}
+		sort.Strings(deleted)
+		sort.Strings(added)
+		renames, err := findRenames(basePath, deleted, sidePath, added, getRenameThreshold())
+		if err != nil {
+			return nil, err
+		}
+		byOldPath := make(map[string]string)
+		for _, rename := range renames {
+			byOldPath[rename.OldPath] = rename.NewPath
+		}
+		return byOldPath, nil
+	}
+	yoursRenames, err := renamesOf(yoursPath, inYours)
+	if err != nil {
+		return nil, err
+	}
+	otherRenames, err := renamesOf(otherPath, inOther)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string][3]string)
+	for oldPath, newPath := range yoursRenames {
+		otherNewPath, renamedByOther := otherRenames[oldPath]
+		switch {
+		case renamedByOther && otherNewPath == newPath:
+			names[newPath] = [3]string{oldPath, newPath, newPath}
+		case ! renamedByOther && inOther[oldPath] && ! inOther[newPath]:
+			names[newPath] = [3]string{oldPath, newPath, oldPath}
+		}
+	}
+	for oldPath, newPath := range otherRenames {
+		if _, renamedByYours := yoursRenames[oldPath]; ! renamedByYours && inYours[oldPath] && ! inYours[newPath] {
+			names[newPath] = [3]string{oldPath, oldPath, newPath}
+		}
+	}
+	return names, nil
+}
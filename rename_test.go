@@ -0,0 +1,204 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+
+// testLines returns n different lines starting with prefix.
+func testLines(prefix string, n int) string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = prefix + strings.Repeat("x", i) + "\n"
+	}
+	return strings.Join(lines, "")
+}
+
+
+func TestFindRenames(t *testing.T) {
+	ten := testLines("line", 10)
+	nineOfTen := strings.Replace(ten, "line\n", "changed\n", 1)
+
+	cases := []struct {
+		name string
+		old, new map[string]string
+		threshold int
+		want []RenamedFile
+	}{
+		{
+			"unchanged move",
+			map[string]string{"a.txt": ten},
+			map[string]string{"dir/a.txt": ten},
+			50, []RenamedFile{{"a.txt", "dir/a.txt", 100}},
+		},
+		{
+			"changed move",
+			map[string]string{"a.txt": ten},
+			map[string]string{"b.txt": nineOfTen},
+			50, []RenamedFile{{"a.txt", "b.txt", 90}},
+		},
+		{
+			"changed move under the threshold",
+			map[string]string{"a.txt": ten},
+			map[string]string{"b.txt": nineOfTen},
+			95, []RenamedFile{},
+		},
+		{
+			"only unchanged files at 100",
+			map[string]string{"a.txt": ten, "c.txt": testLines("c", 5)},
+			map[string]string{"b.txt": nineOfTen, "d.txt": testLines("c", 5)},
+			100, []RenamedFile{{"c.txt", "d.txt", 100}},
+		},
+		{
+			"different files",
+			map[string]string{"a.txt": ten},
+			map[string]string{"b.txt": testLines("other", 10)},
+			50, []RenamedFile{},
+		},
+		{
+			"empty files are not paired",
+			map[string]string{"a.txt": ""},
+			map[string]string{"b.txt": ""},
+			50, []RenamedFile{},
+		},
+		{
+			"the most alike is taken",
+			map[string]string{"a.txt": ten},
+			map[string]string{"b.txt": nineOfTen, "c.txt": ten},
+			50, []RenamedFile{{"a.txt", "c.txt", 100}},
+		},
+		{
+			"each file is paired once",
+			map[string]string{"a.txt": ten, "b.txt": ten},
+			map[string]string{"c.txt": ten},
+			50, []RenamedFile{{"a.txt", "c.txt", 100}},
+		},
+		{
+			"binary files only when unchanged",
+			map[string]string{"a.bin": "\x00\x01\x02", "b.bin": "\x00\x01\x03"},
+			map[string]string{"c.bin": "\x00\x01\x02", "d.bin": "\x00\x01\x04"},
+			50, []RenamedFile{{"a.bin", "c.bin", 100}},
+		},
+		{
+			"nothing added",
+			map[string]string{"a.txt": ten},
+			map[string]string{},
+			50, []RenamedFile{},
+		},
+	}
+
+	for _, c := range cases {
+		dirPath := t.TempDir()
+		oldDir, newDir := filepath.Join(dirPath, "old"), filepath.Join(dirPath, "new")
+		writeTestTree(t, oldDir, c.old)
+		writeTestTree(t, newDir, c.new)
+		deleted, added := sortedKeys(c.old), sortedKeys(c.new)
+
+		got, err := findRenames(oldDir, deleted, newDir, added, c.threshold)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if ! reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+
+func TestMergeRenames(t *testing.T) {
+	// the rename threshold is read from the settings under the home folder.
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SNAP_USER_COMMON", "")
+
+	ten := testLines("line", 10)
+	edited := ten + "added\n"
+
+	cases := []struct {
+		name string
+		base, yours, other map[string]string
+		want map[string][3]string
+	}{
+		{
+			"renamed by yours, edited by other",
+			map[string]string{"a.txt": ten},
+			map[string]string{"b.txt": ten},
+			map[string]string{"a.txt": edited},
+			map[string][3]string{"b.txt": {"a.txt", "b.txt", "a.txt"}},
+		},
+		{
+			"renamed and edited by other",
+			map[string]string{"a.txt": ten},
+			map[string]string{"a.txt": ten},
+			map[string]string{"dir/a.txt": edited},
+			map[string][3]string{"dir/a.txt": {"a.txt", "a.txt", "dir/a.txt"}},
+		},
+		{
+			"renamed alike by both",
+			map[string]string{"a.txt": ten},
+			map[string]string{"b.txt": edited},
+			map[string]string{"b.txt": ten},
+			map[string][3]string{"b.txt": {"a.txt", "b.txt", "b.txt"}},
+		},
+		{
+			"renamed differently",
+			map[string]string{"a.txt": ten},
+			map[string]string{"b.txt": ten},
+			map[string]string{"c.txt": ten},
+			map[string][3]string{},
+		},
+		{
+			"renamed by yours, deleted by other",
+			map[string]string{"a.txt": ten, "x.txt": "x\n"},
+			map[string]string{"b.txt": ten, "x.txt": "x\n"},
+			map[string]string{"x.txt": "x\n"},
+			map[string][3]string{},
+		},
+		{
+			"renamed by yours onto a file other added",
+			map[string]string{"a.txt": ten},
+			map[string]string{"b.txt": ten},
+			map[string]string{"a.txt": ten, "b.txt": "new\n"},
+			map[string][3]string{},
+		},
+		{
+			"nothing renamed",
+			map[string]string{"a.txt": ten},
+			map[string]string{"a.txt": edited},
+			map[string]string{"a.txt": ten, "c.txt": "c\n"},
+			map[string][3]string{},
+		},
+	}
+
+	for _, c := range cases {
+		dirPath := t.TempDir()
+		basePath, yoursPath, otherPath := filepath.Join(dirPath, "base"), filepath.Join(dirPath, "yours"),
+			filepath.Join(dirPath, "other")
+		writeTestTree(t, basePath, c.base)
+		writeTestTree(t, yoursPath, c.yours)
+		writeTestTree(t, otherPath, c.other)
+
+		got, err := mergeRenames(basePath, yoursPath, otherPath)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if ! reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+
+func sortedKeys(files map[string]string) []string {
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+
+func updateSettings(w http.ResponseWriter, r *http.Request) {
+	rootPath, _ := GetRootPath()
+
+	settings, err := getSettings()
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		index, err := readCacheIndex()
+		if err != nil {
+			errorPage(w, err)
+			return
+		}
+		var cacheSize int64
+		for _, entry := range index {
+			cacheSize += entry.Size
+		}
+
+		type Context struct {
+			CacheLimitMB int64
+			CacheUsedMB string
+			CachedSnapshots int
+			RetryAttempts int
+			RetryDelayMS int64
+			RenameThreshold int
+		}
+		policy := getRetryPolicy()
+		tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/settings.html"))
+		tmpl.Execute(w, Context{getCacheLimit() / 1024 / 1024, fmt.Sprintf("%.1f", float64(cacheSize) / 1024 / 1024),
+			len(index), policy.Attempts, policy.BaseDelay.Milliseconds(), getRenameThreshold()})
+
+	} else {
+		if r.FormValue("clear_cache") == "true" {
+			err = clearCache()
+			if err != nil {
+				errorPage(w, err)
+				return
+			}
+			http.Redirect(w, r, "/settings", 307)
+			return
+		}
+
+		limitMB, err := strconv.ParseInt(r.FormValue("cache_limit_mb"), 10, 64)
+		if err != nil || limitMB < 0 {
+			errorPage(w, errors.New("The cache limit must be a whole number of megabytes."))
+			return
+		}
+		settings["cache_limit_mb"] = strconv.FormatInt(limitMB, 10)
+
+		attempts, err := strconv.Atoi(r.FormValue("retry_attempts"))
+		if err != nil || attempts < 1 {
+			errorPage(w, errors.New("The number of attempts must be a whole number from 1."))
+			return
+		}
+		delayMS, err := strconv.Atoi(r.FormValue("retry_delay_ms"))
+		if err != nil || delayMS < 0 {
+			errorPage(w, errors.New("The retry delay must be a whole number of milliseconds."))
+			return
+		}
+		settings["retry_attempts"] = strconv.Itoa(attempts)
+		settings["retry_delay_ms"] = strconv.Itoa(delayMS)
+
+		threshold, err := strconv.Atoi(r.FormValue("rename_threshold"))
+		if err != nil || threshold < 1 || threshold > 100 {
+			errorPage(w, errors.New("The rename similarity must be a whole number from 1 to 100."))
+			return
+		}
+		settings["rename_threshold"] = strconv.Itoa(threshold)
+
+		jsonBytes, err := json.Marshal(settings)
+		if err != nil {
+			errorPage(w, errors.Wrap(err, "json error"))
+			return
+		}
+		err = os.WriteFile(filepath.Join(rootPath, "settings.json"), jsonBytes, 0777)
+		if err != nil {
+			errorPage(w, errors.Wrap(err, "os write error"))
+			return
+		}
+
+		// shrink the cache to the new limit now.
+		cacheMutex.Lock()
+		index, err := readCacheIndex()
+		if err == nil {
+			evictFromCache(index, getCacheLimit())
+			err = writeCacheIndex(index)
+		}
+		cacheMutex.Unlock()
+		if err != nil {
+			errorPage(w, err)
+			return
+		}
+
+		http.Redirect(w, r, "/", 307)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
   "fmt"
+  "html"
   "html/template"
   "strings"
   "net/http"
@@ -11,10 +12,6 @@ import (
   "math/rand"
   "time"
   "encoding/json"
-	"cloud.google.com/go/storage"
-	"context"
-  "google.golang.org/api/option"
-  "io"
 )
 
 const VersionFormat = "20060102T150405MST"
@@ -74,6 +71,9 @@ func errorPage(w http.ResponseWriter, err error) {
 	}
 	msg := fmt.Sprintf("%+v", err)
 	fmt.Println(msg)
+	// messages carry file paths and names from other people's snapshots, so they are
+	// escaped before the line breaks and spaces are turned into markup.
+	msg = html.EscapeString(msg)
 	msg = strings.ReplaceAll(msg, "\n", "<br>")
 	msg = strings.ReplaceAll(msg, " ", "&nbsp;")
 	msg = strings.ReplaceAll(msg, "\t", "&nbsp;&nbsp;")
@@ -82,6 +82,17 @@ func errorPage(w http.ResponseWriter, err error) {
 }
 
 
+// jsonError is errorPage for the handlers that serve JSON: the error goes in an
+// "error" field with status as the HTTP status.
+func jsonError(w http.ResponseWriter, status int, err error) {
+	fmt.Printf("%+v\n", err)
+	jsonBytes, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
+
+
 func emptyDir(path string) error {
 	objFIs, err := os.ReadDir(path)
 	if err != nil {
@@ -94,94 +105,116 @@ func emptyDir(path string) error {
 }
 
 
-func uploadFile(bucketName, sakPath, objectName string, objectData []byte) error {
-  ctx := context.Background()
-  client, err := storage.NewClient(ctx, option.WithCredentialsFile(sakPath))
-  if err != nil {
-    return errors.Wrap(err, "storage error")
-  }
-  defer client.Close()
-
-  // Upload an object with storage.Writer.
-  wc := client.Bucket(bucketName).Object(objectName).NewWriter(ctx)
-  wc.Write(objectData)
-  if err := wc.Close(); err != nil {
-    return errors.Wrap(err, "storage error")
-  }
-  return nil
+// UserProfile is the user of this computer. It is saved in user_data.json and as
+// users/<email> in every project the user is a member of.
+type UserProfile struct {
+	Email string `json:"email"`
+	FullName string `json:"fullname"`
 }
 
 
-func downloadFileAsBytes(bucketName, sakPath, objectName string) ([]byte, error) {
-  ctx := context.Background()
-  client, err := storage.NewClient(ctx, option.WithCredentialsFile(sakPath))
-  if err != nil {
-    return nil, errors.Wrap(err, "storage error")
-  }
-  defer client.Close()
-
-  rc, err := client.Bucket(bucketName).Object(objectName).NewReader(ctx)
-  if err != nil {
-  	return nil, errors.Wrap(err, "storage error")
-  }
-  data, err := io.ReadAll(rc)
-  if err != nil {
-  	return nil, errors.Wrap(err, "storage error")
-  }
-  return data, nil
-}
-
+func getUserData() (UserProfile, error) {
+	rootPath, _ := GetRootPath()
+	raw, err := os.ReadFile(filepath.Join(rootPath, "user_data.json"))
+	if err != nil {
+		return UserProfile{}, errors.Wrap(err, "os error")
+	}
 
-func doesGCPPathExists(bucketName, sakPath, objectName string) (bool, error) {
-  ctx := context.Background()
-  client, err := storage.NewClient(ctx, option.WithCredentialsFile(sakPath))
-  if err != nil {
-    return false, errors.Wrap(err, "storage error")
-  }
-  defer client.Close()
+	var userData UserProfile
+	err = json.Unmarshal(raw, &userData)
+	if err != nil {
+		return UserProfile{}, errors.Wrap(err, "json error")
+	}
 
-  _, err = client.Bucket(bucketName).Object(objectName).NewReader(ctx)
-  if err != nil {
-  	return false, nil
-  }
-  return true, nil
+	return userData, nil
 }
 
 
-func getUserData() (map[string]string, error) {
+// getSettings returns the user's settings. Settings that were never saved are missing.
+func getSettings() (map[string]string, error) {
 	rootPath, _ := GetRootPath()
-	raw, err := os.ReadFile(filepath.Join(rootPath, "user_data.json"))
+	settings := make(map[string]string)
+	if ! DoesPathExists(filepath.Join(rootPath, "settings.json")) {
+		return settings, nil
+	}
+
+	raw, err := os.ReadFile(filepath.Join(rootPath, "settings.json"))
 	if err != nil {
 		return nil, errors.Wrap(err, "os error")
 	}
-
-	userData := make(map[string]string)
-	err = json.Unmarshal(raw, &userData)
+	err = json.Unmarshal(raw, &settings)
 	if err != nil {
 		return nil, errors.Wrap(err, "json error")
 	}
+	return settings, nil
+}
 
-	return userData, nil
+
+// ProjectConfig is a project's entry in pd/<project>.json: where its data is
+// stored and the key it is encrypted with. Only the fields of the chosen backend
+// are set. The json names are those of the older map based files.
+type ProjectConfig struct {
+	ProjectName string `json:"project_name"`
+	// Backend is "gcs", "s3" or "local". Projects saved before it existed are GCP projects.
+	Backend string `json:"backend,omitempty"`
+
+	GCPBucket string `json:"gcp_bucket,omitempty"`
+	SAKJSON string `json:"sak_json,omitempty"`
+
+	S3Endpoint string `json:"s3_endpoint,omitempty"`
+	S3Bucket string `json:"s3_bucket,omitempty"`
+	S3AccessKey string `json:"s3_access_key,omitempty"`
+	S3SecretKey string `json:"s3_secret_key,omitempty"`
+	S3Region string `json:"s3_region,omitempty"`
+	S3PathStyle bool `json:"s3_path_style,string,omitempty"`
+
+	DirPath string `json:"dir_path,omitempty"`
+
+	EncKey string `json:"enc_key,omitempty"`
 }
 
 
-func getProjectData(projectName string) (map[string]string, error) {
+func getProjectData(projectName string) (ProjectConfig, error) {
 	rootPath, _ := GetRootPath()
 	raw, err := os.ReadFile(filepath.Join(rootPath, "pd", projectName + ".json"))
 	if err != nil {
-		return nil, errors.Wrap(err, "os error")
+		return ProjectConfig{}, errors.Wrap(err, "os error")
 	}
 
-	projectData := make(map[string]string)
+	var projectData ProjectConfig
 	err = json.Unmarshal(raw, &projectData)
 	if err != nil {
-		return nil, errors.Wrap(err, "json error")
+		return ProjectConfig{}, errors.Wrap(err, "json error")
 	}
 
 	return projectData, nil
 }
 
 
+// writeProjectData saves the data of a project, dropping any storage clients
+// made for the data it replaces.
+func writeProjectData(projectData ProjectConfig) error {
+	rootPath, _ := GetRootPath()
+	pdPath := filepath.Join(rootPath, "pd", projectData.ProjectName + ".json")
+	if DoesPathExists(pdPath) {
+		oldPD, err := getProjectData(projectData.ProjectName)
+		if err == nil {
+			dropStoreClients(oldPD)
+		}
+	}
+
+	jsonBytes, err := json.Marshal(projectData)
+	if err != nil {
+		return errors.Wrap(err, "json error")
+	}
+	err = os.WriteFile(pdPath, jsonBytes, 0777)
+	if err != nil {
+		return errors.Wrap(err, "os write error")
+	}
+	return nil
+}
+
+
 func getAllProjects() ([]string, error) {
 	rootPath, _ := GetRootPath()
 	objFIs, err := os.ReadDir(filepath.Join(rootPath, "pd"))
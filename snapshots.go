@@ -7,21 +7,10 @@ import (
 	"os"
 	"github.com/pkg/errors"
 	"html/template"
-	archiver "github.com/mholt/archiver/v3"
 	"time"
-	"encoding/json"
 	"strings"
 	"io/fs"
 	"fmt"
-	"bytes"
-	"github.com/hexops/gotextdiff"
-	"github.com/hexops/gotextdiff/span"
-  "github.com/hexops/gotextdiff/myers"
-  "github.com/otiai10/copy"
-  "cloud.google.com/go/storage"
-	"context"
-  "google.golang.org/api/option"
-  "google.golang.org/api/iterator"
 	"crypto/sha1"
 )
 
@@ -61,6 +50,14 @@ func getExclusionRules(projectName string) (ExRules, error) {
 }
 
 
+// mergeStatePaths are what a merger keeps in the project folder, which are never
+// part of the project.
+var mergeStatePaths = map[string]bool{
+	"merging_final": true, "merging_yours": true, "merging_other": true,
+	".merging_details.txt": true, ".merging_conflicts.json": true, ".merging_tree.json": true,
+}
+
+
 func getCleanFilesList(projectName string) ([]string, error) {
 	exRules, err := getExclusionRules(projectName)
 	if err != nil {
@@ -76,6 +73,12 @@ func getCleanFilesList(projectName string) ([]string, error) {
 			return err
 		}
 
+		if mergeStatePaths[strings.Replace(path, projectPath + "/", "", 1)] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		if ! info.IsDir() {
 			pathToWrite := strings.Replace(path, projectPath + "/", "", 1)
 			dirStatus := checkExrulesDir(pathToWrite, exRules)
@@ -192,293 +195,161 @@ func createSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sakPath := filepath.Join(rootPath, pd["sak_json"])
-	manifestStatus, err := doesGCPPathExists(pd["project_name"], sakPath, userData["email"] + "/manifest.json")
+	store, err := getStore(pd)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
+	// snapshots made while the storage cannot be reached are queued in the outbox
+	// and uploaded in the background.
+	syncOutboxInBackground(store, projectName, userData.Email)
 
-	manifestObj := make([]map[string]string, 0)
-	if manifestStatus {
-		manifestRaw, err := downloadFileAsBytes(pd["gcp_bucket"], sakPath, userData["email"] + "/manifest.json")
-		if err != nil {
+	offline := false
+	manifestObj, err := getManifest(store, userData.Email)
+	if err != nil {
+		if ! isOfflineError(err) {
 			errorPage(w, err)
 			return
 		}
-		err = json.Unmarshal(manifestRaw, &manifestObj)
-		if err != nil {
-			errorPage(w, errors.Wrap(err, "json error"))
-			return
-		}
+		offline = true
+		manifestObj = make([]Snapshot, 0)
 	}
 
 
-
 	if r.Method == http.MethodGet {
-		if manifestStatus {
-			lastSnapshotName := manifestObj[0]["snapshot_name"]
-			// get the last snapshot for comparison
-			lastSnapshotTar, err := downloadFileAsBytes(pd["gcp_bucket"], sakPath, userData["email"]  + "/" + lastSnapshotName + ".tar.gz")
-			if err != nil {
-				errorPage(w, err)
-				return
-			}
-
-			lastSnapshotPath := filepath.Join(rootPath, "flotmp", projectName, lastSnapshotName + ".tar.gz")
-			os.MkdirAll(filepath.Join(rootPath, "flotmp", projectName), 0777)
-			err = os.WriteFile(lastSnapshotPath, lastSnapshotTar, 0777)
-			if err != nil {
-				errorPage(w, errors.Wrap(err, "os error"))
-				return
-			}
-			lastSnapshotUndoPath := filepath.Join(rootPath, "flotmp", projectName, lastSnapshotName)
-			os.RemoveAll(lastSnapshotUndoPath)
-			err = archiver.Unarchive(lastSnapshotPath, lastSnapshotUndoPath)
-			if err != nil {
-				errorPage(w, errors.Wrap(err, "archiver error"))
-				return
-			}
-
-			objsList, err := getCleanFilesList(projectName)
-			if err != nil {
-				errorPage(w, err)
-				return
-			}
-
-			added := make(map[string]string)
-			deleted := make(map[string]string)
-			changed := make(map[string]string)
-			for _, path := range objsList {
-				shortPath := strings.Replace(path, projectPath + "/", "", 1)
-				if DoesPathExists(filepath.Join(lastSnapshotUndoPath, shortPath)) {
-					// do a deep compare
-					rawNew, err := os.ReadFile(path)
-					if err != nil {
-						errorPage(w, errors.Wrap(err, "os error"))
-						return
-					}
-					rawOld, err := os.ReadFile(filepath.Join(lastSnapshotUndoPath, shortPath))
-					if err != nil {
-						errorPage(w, errors.Wrap(err, "os error"))
-						return
-					}
-
-					if ! bytes.Equal(rawNew, rawOld) {
-						changed[shortPath] = makeHTMLFriendly(shortPath)
-					}
-				} else {
-					added[shortPath] = path
-				}
-
-			}
+		// get the last snapshot for comparison
+		lastSnapshotUndoPath, release, hasSnapshot, err := getLastSnapshot(store, projectName, userData.Email, manifestObj)
+		if err != nil {
+			errorPage(w, err)
+			return
+		}
+		defer release()
 
-			oldObjList, err := getAllFilesList(lastSnapshotUndoPath)
+		if hasSnapshot {
+			changes, err := compareWorkingTree(projectName, lastSnapshotUndoPath)
 			if err != nil {
 				errorPage(w, err)
 				return
 			}
-			for _, oldObjPath := range oldObjList {
-				shortPath := strings.Replace(oldObjPath, lastSnapshotUndoPath + "/", "", 1)
-				if ! DoesPathExists(filepath.Join(projectPath, shortPath)) {
-					deleted[shortPath] = oldObjPath
-				}
-			}
-
-			// compute diffs
-			diffs := make(map[string]template.HTML)
-			for key, _ := range changed {
-				rawNew, err := os.ReadFile(filepath.Join(projectPath, key))
-				if err != nil {
-					errorPage(w, err)
-					return
-				}
-
-				rawOld, err := os.ReadFile(filepath.Join(lastSnapshotUndoPath, key))
-				if err != nil {
-					errorPage(w, err)
-					return
-				}
-
-				edits := myers.ComputeEdits(span.URIFromPath(filepath.Base(key)), string(rawOld), string(rawNew))
-				diff := fmt.Sprint(gotextdiff.ToUnified("old", "new", string(rawOld), edits))
-				diff = strings.ReplaceAll(diff, "\n", "<br>")
-				diffs[makeHTMLFriendly(key)] = template.HTML(diff)
-			}
 
-			if len(added) == 0 && len(changed) == 0 && len(deleted) == 0 {
+			if len(changes) == 0 {
 				errorPage(w, errors.New("No changes made."))
 				return
 			}
 			type Context struct {
 				CurrentProject string
 				HasMoreInfo bool
-				Added map[string]string
-				Changed map[string]string
-				Deleted map[string]string
-				Diffs map[string]template.HTML
+				Changes []FileChange
+				NewPath string
+				OldPath string
+				Offline bool
 			}
 
-			tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/create_snapshot.html"))
-		  tmpl.Execute(w, Context{projectName, true, added, changed, deleted, diffs})
+			tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/create_snapshot.html",
+				"templates/diff.html"))
+		  tmpl.Execute(w, Context{projectName, true, changes, projectPath, lastSnapshotUndoPath, offline})
 
 		} else {
 
 			type Context struct {
 				CurrentProject string
 				HasMoreInfo bool
+				Offline bool
 			}
-			tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/create_snapshot.html"))
-		  tmpl.Execute(w, Context{projectName, false})
+			tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/create_snapshot.html",
+				"templates/diff.html"))
+		  tmpl.Execute(w, Context{projectName, false, offline})
 
 		}
 
 	} else {
 
 
-		if ! manifestStatus {
-			// make the first commit
-			outObjs, err := getCleanFilesList(projectName)
-			if err != nil {
-				errorPage(w, err)
-				return
-			}
-
-			tmpPath := filepath.Join(rootPath, "flotmp", UntestedRandomString(10))
-			err = os.MkdirAll(tmpPath, 0777)
-			if err != nil {
-				errorPage(w, errors.Wrap(err, "os error"))
-				return
-			}
-			for _, p := range outObjs {
-				newP := strings.Replace(p, projectPath + "/", "", 1)
-				copy.Copy(p, filepath.Join(tmpPath, newP))
-			}
-
-			objFIs, err := os.ReadDir(tmpPath)
-			if err != nil {
-				errorPage(w, errors.Wrap(err, "os error"))
-				return
-			}
-
-			toArchivePaths := make([]string, 0)
-			for _, objFI := range objFIs {
-				toArchivePaths = append(toArchivePaths, filepath.Join(tmpPath, objFI.Name()))
-			}
-
-		  snapshotName := time.Now().Format(VersionFormat)
-		  outFilePath := filepath.Join(rootPath, "flotmp", snapshotName + ".tar.gz")
-		  err = archiver.Archive(toArchivePaths, outFilePath)
-		  if err != nil {
-		  	errorPage(w, errors.Wrap(err, "archiver error"))
-		  	return
-		  }
-
-		  raw, err := os.ReadFile(outFilePath)
-		  if err != nil {
-		  	errorPage(w, errors.Wrap(err, "os error"))
-		  	return
-		  }
+		outObjs, err := getCleanFilesList(projectName)
+		if err != nil {
+			errorPage(w, err)
+			return
+		}
 
-		  err = uploadFile(pd["gcp_bucket"], sakPath, userData["email"] + "/" + snapshotName + ".tar.gz", raw)
-		  if err != nil {
-		  	errorPage(w, errors.Wrap(err, "storage error"))
-		  	return
-		  }
+		snapshot := newSnapshot(userData, r.FormValue("desc"))
+		snapshot.FileCount = len(outObjs)
 
-		  manifestObj := []map[string]string {
-		  	{
-		  		"snapshot_name": snapshotName,
-		  		"snapshot_desc": r.FormValue("desc"),
-		  	},
-		  }
+		// while older snapshots wait in the outbox this one waits behind them, so
+		// they are uploaded in order.
+		pending, err := getPendingSnapshots(projectName)
+		if err != nil {
+			errorPage(w, err)
+			return
+		}
+		queued := offline || len(pending) > 0
 
-		  jsonBytes, err := json.Marshal(manifestObj)
-		  if err != nil {
-		  	errorPage(w, errors.Wrap(err, "json error"))
-		  	return
+  	if ! queued {
+		  snapshot.Hash, snapshot.Size, err = uploadSnapshotTree(store, userData.Email, snapshot.Name, projectPath, outObjs)
+		  if err == nil {
+			  err = updateManifest(store, userData.Email, addSnapshotEntry(snapshot))
 		  }
-		  err = uploadFile(pd["gcp_bucket"], sakPath, userData["email"] + "/manifest.json", jsonBytes)
-		  if err != nil {
+		  if err != nil && ! isOfflineError(err) {
 		  	errorPage(w, errors.Wrap(err, "storage error"))
 		  	return
 		  }
+		  offline = err != nil
+		  queued = offline
+		}
 
-		  http.Redirect(w, r, "/view_snapshots/" + projectName, 307)
-
-		} else {
-
-			outObjs, err := getCleanFilesList(projectName)
+		if queued {
+			snapshot.Hash, snapshot.Size = "", 0
+			err = queueSnapshot(projectName, snapshot, projectPath, outObjs)
 			if err != nil {
 				errorPage(w, err)
 				return
 			}
-
-			tmpPath := filepath.Join(rootPath, "flotmp", UntestedRandomString(10))
-			err = os.MkdirAll(tmpPath, 0777)
-			if err != nil {
-				errorPage(w, errors.Wrap(err, "os error"))
-				return
-			}
-			for _, p := range outObjs {
-				newP := strings.Replace(p, projectPath + "/", "", 1)
-				copy.Copy(p, filepath.Join(tmpPath, newP))
-			}
-
-			objFIs, err := os.ReadDir(tmpPath)
-			if err != nil {
-				errorPage(w, errors.Wrap(err, "os error"))
-				return
-			}
-
-			toArchivePaths := make([]string, 0)
-			for _, objFI := range objFIs {
-				toArchivePaths = append(toArchivePaths, filepath.Join(tmpPath, objFI.Name()))
+			if ! offline {
+				syncOutboxInBackground(store, projectName, userData.Email)
 			}
+		}
 
-		  snapshotName := time.Now().Format(VersionFormat)
-		  outFilePath := filepath.Join(rootPath, "flotmp", snapshotName + ".tar.gz")
-		  err = archiver.Archive(toArchivePaths, outFilePath)
-		  if err != nil {
-		  	errorPage(w, errors.Wrap(err, "archiver error"))
-		  	return
-		  }
-
-		  raw, err := os.ReadFile(outFilePath)
-		  if err != nil {
-		  	errorPage(w, errors.Wrap(err, "os error"))
-		  	return
-		  }
-
-		  err = uploadFile(pd["gcp_bucket"], sakPath, userData["email"] + "/" + snapshotName + ".tar.gz", raw)
-		  if err != nil {
-		  	errorPage(w, errors.Wrap(err, "storage error"))
-		  	return
-		  }
+	  http.Redirect(w, r, "/view_snapshots/" + projectName, 307)
+	}
 
-			aManifestObj := map[string]string {
-	  		"snapshot_name": snapshotName,
-	  		"snapshot_desc": r.FormValue("desc"),
-	  	}
+}
 
-	  	newManifestObj := append([]map[string]string{aManifestObj}, manifestObj...)
 
-	  	jsonBytes, err := json.Marshal(newManifestObj)
-		  if err != nil {
-		  	errorPage(w, errors.Wrap(err, "json error"))
-		  	return
-		  }
-		  err = uploadFile(pd["gcp_bucket"], sakPath, userData["email"] + "/manifest.json", jsonBytes)
-		  if err != nil {
-		  	errorPage(w, errors.Wrap(err, "storage error"))
-		  	return
-		  }
-
-		  http.Redirect(w, r, "/view_snapshots/" + projectName, 307)
+// getLastSnapshot returns a folder with your latest snapshot and a func to call
+// when done with it. Snapshots still in the outbox are newer than those of the
+// manifest, so the newest of them is used when there are any. hasSnapshot is
+// false when you have no snapshot at all.
+func getLastSnapshot(store Store, projectName, email string, manifestObj []Snapshot) (string, func(), bool, error) {
+	noRelease := func() {}
+	for i := 0; i < 2; i++ {
+		pending, err := getPendingSnapshots(projectName)
+		if err != nil {
+			return "", noRelease, false, err
+		}
+		if len(pending) == 0 || (len(manifestObj) > 0 && ! snapshotTimeBefore(manifestObj[0].Name, pending[0].Name)) {
+			break
+		}
+		unpackPath, err := unpackPendingSnapshot(projectName, pending[0].Name)
+		if err == nil {
+			return unpackPath, noRelease, true, nil
+		}
+		if ! errors.Is(err, os.ErrNotExist) || i == 1 {
+			return "", noRelease, false, err
+		}
+		// the background sync uploaded it in between.
+		manifestObj, err = getManifest(store, email)
+		if err != nil {
+			return "", noRelease, false, err
 		}
-
 	}
 
+	if len(manifestObj) == 0 {
+		return "", noRelease, false, nil
+	}
+	snapshotPath, release, err := getCachedSnapshot(store, projectName, email, manifestObj[0].Name, manifestObj[0].Hash)
+	if err != nil {
+		return "", noRelease, false, err
+	}
+	return snapshotPath, release, true, nil
 }
 
 
@@ -497,67 +368,50 @@ func viewSnapshots(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, err)
 		return
 	}
-	sakPath := filepath.Join(rootPath, pd["sak_json"])
-
-	manifestStatus, err := doesGCPPathExists(pd["project_name"], sakPath, userData["email"] + "/manifest.json")
+	store, err := getStore(pd)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
 
+	syncOutboxInBackground(store, projectName, userData.Email)
+
 	projects, err := getAllProjects()
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
 
-	snapshots := make([]map[string]string, 0)
-	if manifestStatus {
-		manifestRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, userData["email"] + "/manifest.json")
-		if err != nil {
-			errorPage(w, err)
-			return
-		}
-
-		err = json.Unmarshal(manifestRaw, &snapshots)
-		if err != nil {
-			errorPage(w, errors.Wrap(err, "json error"))
-			return
-		}
+	snapshots, err := getManifest(store, userData.Email)
+	users := make([]string, 0)
+	if err == nil {
+		users, err = getTeamMembers(store, userData.Email)
+	}
+	if err != nil && ! isOfflineError(err) {
+		errorPage(w, err)
+		return
+	}
+	offline := err != nil
+	if offline {
+		snapshots = make([]Snapshot, 0)
+		users = make([]string, 0)
 	}
 
-	ctx := context.Background()
-  client, err := storage.NewClient(ctx, option.WithCredentialsFile(sakPath))
-  if err != nil {
-    errorPage(w, errors.Wrap(err, "storage error"))
-    return
-  }
-  defer client.Close()
-
-  users := make([]string, 0)
-  it := client.Bucket(pd["gcp_bucket"]).Objects(ctx, &storage.Query{Prefix: "users/"})
-  for {
-    attrs, err := it.Next()
-    if err == iterator.Done {
-      break
-    }
-    if err != nil {
-      errorPage(w, errors.Wrap(err, "storage error"))
-    	return
-    }
-    if attrs.Name != "users/" {
-    	s := strings.ReplaceAll(attrs.Name, "users/", "")
-    	if s == userData["email"] {
-    		continue
-    	}
-    	users = append(users, s)
-    }
-  }
+	pending, err := getPendingSnapshots(projectName)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
 
   hasMerger := false
 	if DoesPathExists(filepath.Join(rootPath, "p", projectName, ".merging_details.txt")) {
 		hasMerger = true
 	}
+	conflicts, err := getMergeConflicts(projectName)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
 
 	nc := false
 	if len(snapshots) > 100 {
@@ -568,12 +422,16 @@ func viewSnapshots(w http.ResponseWriter, r *http.Request) {
 	type Context struct {
 		Projects []string
 		CurrentProject string
-		Snapshots []map[string]string
+		Snapshots []Snapshot
 		SnapshotTime func(s string) string
 		CleanSnapshotDesc func(s string) template.HTML
 		Users []string
 		HasMerger bool
 		NeedsCleaning bool
+		Pending []Snapshot
+		Offline bool
+		Conflicts []MergeConflict
+		Email string
 	}
 
 	st := func(s string) string {
@@ -591,5 +449,5 @@ func viewSnapshots(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/view_snapshots.html"))
-  tmpl.Execute(w, Context{projects, projectName, snapshots, st, csd, users, hasMerger, nc})
+  tmpl.Execute(w, Context{projects, projectName, snapshots, st, csd, users, hasMerger, nc, pending, offline, conflicts, userData.Email})
 }
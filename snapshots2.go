@@ -4,17 +4,12 @@ import(
 	"net/http"
 	"github.com/gorilla/mux"
 	"path/filepath"
-	"encoding/json"
 	"github.com/pkg/errors"
-	archiver "github.com/mholt/archiver/v3"
 	"strings"
 	"time"
 	"os"
 	"html/template"
   "github.com/otiai10/copy"
-  "cloud.google.com/go/storage"
-	"context"
-  "google.golang.org/api/option"
 )
 
 
@@ -22,7 +17,6 @@ func viewSnapshot(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	projectName := vars["proj"]
 	snapshotName := vars["sname"]
-	rootPath, _ := GetRootPath()
 
 	pd, err := getProjectData(projectName)
 	if err != nil {
@@ -34,52 +28,36 @@ func viewSnapshot(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, err)
 		return
 	}
-	sakPath := filepath.Join(rootPath, pd["sak_json"])
-
-	manifestRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, userData["email"] + "/manifest.json")
+	store, err := getStore(pd)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	projects, err := getAllProjects()
+
+	snapshots, err := getManifest(store, userData.Email)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-
-	snapshots := make([]map[string]string, 0)
-	err = json.Unmarshal(manifestRaw, &snapshots)
+	projects, err := getAllProjects()
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "json error"))
+		errorPage(w, err)
 		return
 	}
 
-	var snapshotDesc string
-	for _, snapshotObj := range snapshots {
-		if snapshotObj["snapshot_name"] == snapshotName {
-			snapshotDesc = snapshotObj["snapshot_desc"]
-		}
+	snapshotObj := findSnapshot(snapshots, snapshotName)
+	if snapshotObj == nil {
+		errorPage(w, errors.New("The snapshot " + snapshotName + " does not exist."))
+		return
 	}
+	snapshotDesc := snapshotObj.Desc
 
-	snapshotRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, userData["email"] + "/" + snapshotName + ".tar.gz")
+	snapshotUndoPath, release, err := getCachedSnapshot(store, projectName, userData.Email, snapshotName, snapshotObj.Hash)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	snapshotPath := filepath.Join(rootPath, "flotmp", projectName, snapshotName + ".tar.gz")
-	os.MkdirAll(filepath.Join(rootPath, "flotmp", projectName), 0777)
-	err = os.WriteFile(snapshotPath, snapshotRaw, 0777)	
-	if err != nil {
-		errorPage(w, errors.Wrap(err, "os error"))
-		return
-	}
-	snapshotUndoPath := filepath.Join(rootPath, "flotmp", projectName, snapshotName)
-	os.RemoveAll(snapshotUndoPath)
-	err = archiver.Unarchive(snapshotPath, snapshotUndoPath)
-	if err != nil {
-		errorPage(w, errors.Wrap(err, "archiver error"))
-		return
-	}
+	defer release()
 
 	filesInSnapshot := make(map[string]string)
 	oldObjList, err := getAllFilesList(snapshotUndoPath)
@@ -100,6 +78,7 @@ func viewSnapshot(w http.ResponseWriter, r *http.Request) {
 		SnapshotDesc template.HTML
 		FilesInSnapshot map[string]string
 		SnapshotPath string
+		Email string
 	}
 
 	st := func(s string) string {
@@ -118,7 +97,7 @@ func viewSnapshot(w http.ResponseWriter, r *http.Request) {
 
 	tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/view_snapshot.html"))
   tmpl.Execute(w, Context{projects, projectName, snapshotName, st(snapshotName), csd(snapshotDesc),
-  	filesInSnapshot, snapshotUndoPath})
+  	filesInSnapshot, snapshotUndoPath, userData.Email})
 }
 
 
@@ -138,27 +117,30 @@ func revertToThis(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, err)
 		return
 	}
-	sakPath := filepath.Join(rootPath, pd["sak_json"])
-
-	// download and replace path
-	snapshotRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, userData["email"] + "/" + snapshotName + ".tar.gz")
+	store, err := getStore(pd)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	snapshotPath := filepath.Join(rootPath, "flotmp", projectName, snapshotName + ".tar.gz")
-	os.MkdirAll(filepath.Join(rootPath, "flotmp", projectName), 0777)
-	err = os.WriteFile(snapshotPath, snapshotRaw, 0777)	
+
+	snapshots, err := getManifest(store, userData.Email)
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "os error"))
+		errorPage(w, err)
 		return
 	}
-	snapshotUndoPath := filepath.Join(rootPath, "flotmp", projectName, snapshotName)
-	err = archiver.Unarchive(snapshotPath, snapshotUndoPath)
+	snapshotObj := findSnapshot(snapshots, snapshotName)
+	if snapshotObj == nil {
+		errorPage(w, errors.New("The snapshot " + snapshotName + " does not exist."))
+		return
+	}
+
+	// download and replace path
+	snapshotUndoPath, release, err := getCachedSnapshot(store, projectName, userData.Email, snapshotName, snapshotObj.Hash)
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "archiver error"))
+		errorPage(w, err)
 		return
 	}
+	defer release()
 
 	snapshotObjFIs, err := os.ReadDir(snapshotUndoPath)
 	if err != nil {
@@ -173,9 +155,11 @@ func revertToThis(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// upload snapshot object
-	newSnapshotName := time.Now().Format(VersionFormat)
+	snapshot := newSnapshot(userData, snapshotObj.Desc)
+	snapshot.Origin = &SnapshotOrigin{OriginRevert, SnapshotRef{userData.Email, snapshotName}}
+	snapshot.FileCount, snapshot.Hash, snapshot.Size = snapshotObj.FileCount, snapshotObj.Hash, snapshotObj.Size
 
-  err = uploadFile(pd["gcp_bucket"], sakPath, userData["email"] + "/" + newSnapshotName + ".tar.gz", snapshotRaw)
+  err = copySnapshot(store, userData.Email, snapshotName, userData.Email, snapshot.Name)
   if err != nil {
   	errorPage(w, errors.Wrap(err, "storage error"))
   	return
@@ -183,40 +167,9 @@ func revertToThis(w http.ResponseWriter, r *http.Request) {
 
 
 	// update manifest
-	manifestRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, userData["email"] + "/manifest.json")
-	if err != nil {
-		errorPage(w, err)
-		return
-	}
-
-	snapshots := make([]map[string]string, 0)
-	err = json.Unmarshal(manifestRaw, &snapshots)
-	if err != nil {
-		errorPage(w, errors.Wrap(err, "json error"))
-		return
-	}
-
-	var snapshotDesc string
-	for _, snapshotObj := range snapshots {
-		if snapshotObj["snapshot_name"] == snapshotName {
-			snapshotDesc = snapshotObj["snapshot_desc"]
-		}
-	}
-
-	aManifestObj := map[string]string {
-		"snapshot_name": newSnapshotName,
-		"snapshot_desc": snapshotDesc + "\n\nThis snapshot was created after a revert action",
-	}
-	newManifestObj := append([]map[string]string{aManifestObj}, snapshots...)
-
-	jsonBytes, err := json.Marshal(newManifestObj)
+  err = updateManifest(store, userData.Email, addSnapshotEntry(snapshot))
   if err != nil {
-  	errorPage(w, errors.Wrap(err, "json error"))
-  	return
-  }
-  err = uploadFile(pd["gcp_bucket"], sakPath, userData["email"] + "/manifest.json", jsonBytes)
-  if err != nil {
-  	errorPage(w, errors.Wrap(err, "storage error"))
+  	errorPage(w, err)
   	return
   }
 
@@ -229,7 +182,6 @@ func fixSnapshotDesc(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	projectName := vars["proj"]
 	snapshotName := vars["sname"]
-	rootPath, _ := GetRootPath()
 
 	pd, err := getProjectData(projectName)
 	if err != nil {
@@ -241,31 +193,26 @@ func fixSnapshotDesc(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, err)
 		return
 	}
-	sakPath := filepath.Join(rootPath, pd["sak_json"])
-
-	manifestRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, userData["email"] + "/manifest.json")
+	store, err := getStore(pd)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-	projects, err := getAllProjects()
+
+	snapshots, err := getManifest(store, userData.Email)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
-
-	snapshots := make([]map[string]string, 0)
-	err = json.Unmarshal(manifestRaw, &snapshots)
+	projects, err := getAllProjects()
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "json error"))
+		errorPage(w, err)
 		return
 	}
 
 	var snapshotDesc string
-	for _, snapshotObj := range snapshots {
-		if snapshotObj["snapshot_name"] == snapshotName {
-			snapshotDesc = snapshotObj["snapshot_desc"]
-		}
+	if snapshotObj := findSnapshot(snapshots, snapshotName); snapshotObj != nil {
+		snapshotDesc = snapshotObj.Desc
 	}
 
 	if r.Method == http.MethodGet {
@@ -291,38 +238,19 @@ func fixSnapshotDesc(w http.ResponseWriter, r *http.Request) {
 
 	} else {
 		// update manifest
-		manifestRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, userData["email"] + "/manifest.json")
+		err = updateManifest(store, userData.Email, func(snapshots []Snapshot) ([]Snapshot, error) {
+			snapshotObj := findSnapshot(snapshots, snapshotName)
+			if snapshotObj == nil {
+				return nil, errors.New("The snapshot " + snapshotName + " was removed while you were editing its description.")
+			}
+			snapshotObj.Desc = r.FormValue("desc")
+			return snapshots, nil
+		})
 		if err != nil {
 			errorPage(w, err)
 			return
 		}
 
-		snapshots := make([]map[string]string, 0)
-		err = json.Unmarshal(manifestRaw, &snapshots)
-		if err != nil {
-			errorPage(w, errors.Wrap(err, "json error"))
-			return
-		}
-
-		var index int
-		for i, snapshotObj := range snapshots {
-			if snapshotObj["snapshot_name"] == snapshotName {
-				index = i
-			}
-		}
-
-		snapshots[index]["snapshot_desc"] = r.FormValue("desc")
-		jsonBytes, err := json.Marshal(snapshots)
-	  if err != nil {
-	  	errorPage(w, errors.Wrap(err, "json error"))
-	  	return
-	  }
-	  err = uploadFile(pd["gcp_bucket"], sakPath, userData["email"] + "/manifest.json", jsonBytes)
-	  if err != nil {
-	  	errorPage(w, errors.Wrap(err, "storage error"))
-	  	return
-	  }
-
 	  http.Redirect(w, r, "/view_snapshots/" + projectName, 307)		  
 
 	}
@@ -333,7 +261,6 @@ func fixSnapshotDesc(w http.ResponseWriter, r *http.Request) {
 func cleanSnapshots(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	projectName := vars["proj"]
-	rootPath, _ := GetRootPath()
 
 	pd, err := getProjectData(projectName)
 	if err != nil {
@@ -345,49 +272,45 @@ func cleanSnapshots(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, err)
 		return
 	}
-	sakPath := filepath.Join(rootPath, pd["sak_json"])
-
-	snapshots := make([]map[string]string, 0)
-	manifestRaw, err := downloadFileAsBytes(pd["project_name"], sakPath, userData["email"] + "/manifest.json")
+	store, err := getStore(pd)
 	if err != nil {
 		errorPage(w, err)
 		return
 	}
 
-	err = json.Unmarshal(manifestRaw, &snapshots)
+	toDelete := make([]string, 0)
+	err = updateManifest(store, userData.Email, func(snapshots []Snapshot) ([]Snapshot, error) {
+		toDelete = make([]string, 0)
+		newSnapshots := make([]Snapshot, 0)
+		for i, snapshotObj := range snapshots {
+			if i > 20 {
+			// if i > 2 {
+				toDelete = append(toDelete, snapshotObj.Name)
+			} else {
+				newSnapshots = append(newSnapshots, snapshotObj)
+			}
+		}
+		return newSnapshots, nil
+	})
 	if err != nil {
-		errorPage(w, errors.Wrap(err, "json error"))
+		errorPage(w, err)
 		return
 	}
 
-	ctx := context.Background()
-  client, err := storage.NewClient(ctx, option.WithCredentialsFile(sakPath))
-  if err != nil {
-		errorPage(w, errors.Wrap(err, "storage error"))
-		return
-  }
-  defer client.Close()
-
-  newSnapshots := make([]map[string]string, 0)
-	for i, snapshotObj := range snapshots {
-		if i > 20 {
-		// if i > 2 {
-			client.Bucket(pd["gcp_bucket"]).Object(userData["email"] + "/" + snapshotObj["snapshot_name"] + ".tar.gz").Delete(ctx)
-		} else {
-			newSnapshots = append(newSnapshots, snapshotObj)
+	// the snapshots are deleted only after the manifest stops listing them.
+	for _, snapshotName := range toDelete {
+		err = deleteSnapshot(store, userData.Email, snapshotName)
+		if err != nil {
+			errorPage(w, err)
+			return
 		}
 	}
-
-	jsonBytes, err := json.Marshal(newSnapshots)
-  if err != nil {
-  	errorPage(w, errors.Wrap(err, "json error"))
-  	return
-  }
-  err = uploadFile(pd["gcp_bucket"], sakPath, userData["email"] + "/manifest.json", jsonBytes)
-  if err != nil {
-  	errorPage(w, errors.Wrap(err, "storage error"))
-  	return
-  }
+	// while someone uploads, the unused blobs are left for the next clean up.
+	_, err = collectGarbage(store)
+	if err != nil && err != ErrUploadRunning {
+		errorPage(w, err)
+		return
+	}
 
   http.Redirect(w, r, "/view_snapshots/" + projectName, 307)
 }
\ No newline at end of file
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+
+// Store is what every project backend must provide. The object names are the
+// same on all backends: desc.md, creator.json, users/<email>, <email>/exrules.txt,
+// <email>/manifest.json, <email>/<snapshot>.tree.json, blobs/<sha256>, the
+// markers under uploads/ and gc/ and the <email>/<snapshot>.tar.gz of older snapshots.
+type Store interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	Exists(name string) (bool, error)
+	// List returns the full names of all objects whose name begins with prefix.
+	List(prefix string) ([]string, error)
+	Delete(name string) error
+
+	// NewReader and NewWriter stream an object so big snapshots are never held
+	// in memory.
+	NewReader(name string) (io.ReadCloser, error)
+	NewWriter(name string) (ObjectWriter, error)
+
+	// GetWithVersion also returns a token for the version of the object read.
+	// A missing object has no data and an empty version.
+	GetWithVersion(name string) ([]byte, string, error)
+	// PutIfVersion only writes when the object is still at the version passed,
+	// an empty version meaning the object must not exist. Otherwise it returns
+	// ErrVersionMismatch.
+	PutIfVersion(name string, data []byte, version string) error
+}
+
+
+var ErrVersionMismatch = errors.New("the object was changed by someone else")
+
+var ErrStoreUnreachable = errors.New("the storage cannot be reached")
+
+
+// ObjectWriter is returned by Store.NewWriter. Nothing appears under the
+// object's name until Close returns without an error. Abort throws away
+// everything written.
+type ObjectWriter interface {
+	io.Writer
+	Close() error
+	Abort()
+}
+
+
+// getStore returns the store for a project's data, retrying transient failures
+// and encrypting everything when the project has a key.
+func getStore(pd ProjectConfig) (Store, error) {
+	backend, err := getBackendStore(pd)
+	if err != nil {
+		return nil, err
+	}
+	var store Store = RetryStore{backend, getRetryPolicy()}
+	if pd.EncKey != "" {
+		return NewEncryptedStore(store, pd.EncKey)
+	}
+	return store, nil
+}
+
+
+// getBackendStore returns the driver selected by the Backend of a project's data.
+func getBackendStore(pd ProjectConfig) (Store, error) {
+	rootPath, _ := GetRootPath()
+
+	switch pd.Backend {
+	case "", "gcs":
+		return GCSStore{pd.GCPBucket, filepath.Join(rootPath, pd.SAKJSON)}, nil
+	case "local":
+		if ! filepath.IsAbs(pd.DirPath) {
+			return nil, errors.New("the project directory must be an absolute path")
+		}
+		return LocalStore{pd.DirPath}, nil
+	case "s3":
+		return S3Store{pd.S3Endpoint, pd.S3Bucket, pd.S3AccessKey, pd.S3SecretKey, pd.S3Region, pd.S3PathStyle}, nil
+	default:
+		return nil, errors.New("unknown storage backend: " + pd.Backend)
+	}
+}
+
+
+// getTeamMembers returns the emails of all the members of a project except
+// the email passed in.
+func getTeamMembers(store Store, exceptEmail string) ([]string, error) {
+	names, err := store.List("users/")
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]string, 0)
+	for _, name := range names {
+		if name == "users/" {
+			continue
+		}
+		s := strings.Replace(name, "users/", "", 1)
+		if s == exceptEmail {
+			continue
+		}
+		users = append(users, s)
+	}
+	return users, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+	"google.golang.org/api/option"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+
+// the storage clients are expensive to set up (credential parsing, TLS handshakes)
+// so one client is kept per bucket and credentials for the life of the program.
+type gcsClientEntry struct {
+	client *storage.Client
+	sakModTime time.Time
+}
+
+var gcsClients = make(map[string]gcsClientEntry)
+var s3Clients = make(map[string]*minio.Client)
+var clientsMutex sync.Mutex
+
+
+func gcsClientKey(bucketName, sakPath string) string {
+	return bucketName + "\n" + sakPath
+}
+
+
+func getGCSClient(bucketName, sakPath string) (*storage.Client, error) {
+	fi, err := os.Stat(sakPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "os error")
+	}
+
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	key := gcsClientKey(bucketName, sakPath)
+	entry, ok := gcsClients[key]
+	if ok && entry.sakModTime.Equal(fi.ModTime()) {
+		return entry.client, nil
+	}
+	// the key file was replaced since the client was made. The old client is not
+	// closed as requests that got it earlier may still be using it.
+	if ok {
+		delete(gcsClients, key)
+	}
+
+	client, err := storage.NewClient(context.Background(), option.WithCredentialsFile(sakPath))
+	if err != nil {
+		return nil, errors.Wrap(err, "storage error")
+	}
+	gcsClients[key] = gcsClientEntry{client, fi.ModTime()}
+	return client, nil
+}
+
+
+// s3ClientKey is made of every setting newClient uses, so stores that differ in
+// any of them never share a client.
+func s3ClientKey(s S3Store) string {
+	return s.Endpoint + "\n" + s.BucketName + "\n" + s.AccessKey + "\n" + s.SecretKey + "\n" + s.Region +
+		"\n" + strconv.FormatBool(s.PathStyle)
+}
+
+
+func getS3Client(s S3Store) (*minio.Client, error) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	key := s3ClientKey(s)
+	if client, ok := s3Clients[key]; ok {
+		return client, nil
+	}
+	client, err := s.newClient()
+	if err != nil {
+		return nil, err
+	}
+	s3Clients[key] = client
+	return client, nil
+}
+
+
+// dropStoreClients forgets the clients made for a project's data. It is called
+// whenever the data of a project is about to be replaced. The clients are not
+// closed since requests still running may hold them; they are let go with the
+// last of those.
+func dropStoreClients(pd ProjectConfig) {
+	store, err := getBackendStore(pd)
+	if err != nil {
+		return
+	}
+
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	switch s := store.(type) {
+	case GCSStore:
+		delete(gcsClients, gcsClientKey(s.BucketName, s.SAKPath))
+	case S3Store:
+		delete(s3Clients, s3ClientKey(s))
+	}
+}
+
+
+// closeStoreClients closes every client as the program ends.
+func closeStoreClients() {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	for key, entry := range gcsClients {
+		entry.client.Close()
+		delete(gcsClients, key)
+	}
+	for key := range s3Clients {
+		delete(s3Clients, key)
+	}
+}
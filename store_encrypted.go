@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+)
+
+
+// EncryptedStore wraps another store so that everything it saves is ciphertext.
+// An object is a header (magic and a random nonce prefix) followed by chunks
+// sealed with AES-256-GCM. Each chunk's nonce is the prefix, the chunk counter
+// and a flag marking the last chunk, and the object's name is the additional
+// data, so reordered, truncated, swapped or changed objects fail to decrypt.
+//
+// Blobs are named by an HMAC of their contents keyed with nameKey, which comes
+// from the project key, so the storage cannot tell if a known file is stored.
+type EncryptedStore struct {
+	Inner Store
+	aead cipher.AEAD
+	nameKey []byte
+}
+
+const encMagic = "FLOENC1\n"
+const encPrefixSize = 7
+const encChunkSize = 64 * 1024
+
+
+func newProjectKey() (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", errors.Wrap(err, "rand error")
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+
+func NewEncryptedStore(inner Store, projectKey string) (EncryptedStore, error) {
+	key, err := base64.StdEncoding.DecodeString(projectKey)
+	if err != nil || len(key) != 32 {
+		return EncryptedStore{}, errors.New("the project key is not valid")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return EncryptedStore{}, errors.Wrap(err, "aes error")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return EncryptedStore{}, errors.Wrap(err, "aes error")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("floraad blob names"))
+	return EncryptedStore{inner, aead, mac.Sum(nil)}, nil
+}
+
+
+// blobID returns the name of the blob of the contents whose SHA-256 is hash.
+func (s EncryptedStore) blobID(hash string) string {
+	mac := hmac.New(sha256.New, s.nameKey)
+	mac.Write([]byte(hash))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+
+// isEncryptedObject reports if an object in a plain store was written by an EncryptedStore.
+func isEncryptedObject(store Store, name string) (bool, error) {
+	rc, err := store.NewReader(name)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+
+	header := make([]byte, len(encMagic))
+	_, err = io.ReadFull(rc, header)
+	if err != nil {
+		return false, nil
+	}
+	return string(header) == encMagic, nil
+}
+
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encPrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+
+type encryptingWriter struct {
+	inner ObjectWriter
+	aead cipher.AEAD
+	name []byte
+	prefix []byte
+	counter uint32
+	buf []byte
+}
+
+
+func (w *encryptingWriter) sealChunk(chunk []byte, last bool) error {
+	if w.counter == ^uint32(0) {
+		return errors.New("object too large to encrypt")
+	}
+	sealed := w.aead.Seal(nil, chunkNonce(w.prefix, w.counter, last), chunk, w.name)
+	w.counter += 1
+	_, err := w.inner.Write(sealed)
+	return err
+}
+
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	// always keep something back so the last chunk is sealed in Close.
+	for len(w.buf) > encChunkSize {
+		err := w.sealChunk(w.buf[: encChunkSize], false)
+		if err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[encChunkSize :]
+	}
+	return len(p), nil
+}
+
+
+func (w *encryptingWriter) Close() error {
+	err := w.sealChunk(w.buf, true)
+	if err != nil {
+		w.inner.Abort()
+		return errors.Wrap(err, "storage error")
+	}
+	return w.inner.Close()
+}
+
+
+func (w *encryptingWriter) Abort() {
+	w.inner.Abort()
+}
+
+
+type decryptingReader struct {
+	inner io.ReadCloser
+	br *bufio.Reader
+	aead cipher.AEAD
+	name []byte
+	prefix []byte
+	counter uint32
+	plain []byte
+	done bool
+}
+
+
+func (r *decryptingReader) readChunk() error {
+	sealed := make([]byte, encChunkSize + r.aead.Overhead())
+	n, err := io.ReadFull(r.br, sealed)
+	last := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		last = true
+	} else if err != nil {
+		return errors.Wrap(err, "storage error")
+	} else if _, err := r.br.Peek(1); err == io.EOF {
+		last = true
+	}
+
+	plain, err := r.aead.Open(nil, chunkNonce(r.prefix, r.counter, last), sealed[: n], r.name)
+	if err != nil {
+		return errors.New("decryption failed: the object was changed or the project key is wrong")
+	}
+	r.counter += 1
+	r.plain = plain
+	r.done = last
+	return nil
+}
+
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n :]
+	return n, nil
+}
+
+
+func (r *decryptingReader) Close() error {
+	return r.inner.Close()
+}
+
+
+func (s EncryptedStore) encryptTo(inner ObjectWriter, name string) (ObjectWriter, error) {
+	prefix := make([]byte, encPrefixSize)
+	_, err := rand.Read(prefix)
+	if err != nil {
+		inner.Abort()
+		return nil, errors.Wrap(err, "rand error")
+	}
+
+	_, err = inner.Write(append([]byte(encMagic), prefix...))
+	if err != nil {
+		inner.Abort()
+		return nil, errors.Wrap(err, "storage error")
+	}
+	return &encryptingWriter{inner: inner, aead: s.aead, name: []byte(name), prefix: prefix}, nil
+}
+
+
+func (s EncryptedStore) decryptFrom(inner io.ReadCloser, name string) (io.ReadCloser, error) {
+	br := bufio.NewReader(inner)
+	header := make([]byte, len(encMagic) + encPrefixSize)
+	_, err := io.ReadFull(br, header)
+	if err != nil || string(header[: len(encMagic)]) != encMagic {
+		inner.Close()
+		return nil, errors.New("the object " + name + " is not encrypted")
+	}
+	return &decryptingReader{inner: inner, br: br, aead: s.aead, name: []byte(name),
+		prefix: header[len(encMagic) :]}, nil
+}
+
+
+func (s EncryptedStore) NewWriter(name string) (ObjectWriter, error) {
+	inner, err := s.Inner.NewWriter(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.encryptTo(inner, name)
+}
+
+
+func (s EncryptedStore) NewReader(name string) (io.ReadCloser, error) {
+	inner, err := s.Inner.NewReader(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.decryptFrom(inner, name)
+}
+
+
+// bufferObjectWriter collects a small object in memory, for the calls that
+// need the whole ciphertext at once.
+type bufferObjectWriter struct {
+	*bytes.Buffer
+}
+
+func (w bufferObjectWriter) Close() error {
+	return nil
+}
+
+func (w bufferObjectWriter) Abort() {
+}
+
+
+func (s EncryptedStore) GetWithVersion(name string) ([]byte, string, error) {
+	sealed, version, err := s.Inner.GetWithVersion(name)
+	if err != nil || version == "" {
+		return nil, version, err
+	}
+	rc, err := s.decryptFrom(io.NopCloser(bytes.NewReader(sealed)), name)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, version, nil
+}
+
+
+func (s EncryptedStore) PutIfVersion(name string, data []byte, version string) error {
+	buf := bufferObjectWriter{new(bytes.Buffer)}
+	wc, err := s.encryptTo(buf, name)
+	if err != nil {
+		return err
+	}
+	wc.Write(data)
+	err = wc.Close()
+	if err != nil {
+		return err
+	}
+	return s.Inner.PutIfVersion(name, buf.Bytes(), version)
+}
+
+
+func (s EncryptedStore) Put(name string, data []byte) error {
+	wc, err := s.NewWriter(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(wc, bytes.NewReader(data))
+	if err != nil {
+		wc.Abort()
+		return errors.Wrap(err, "storage error")
+	}
+	return wc.Close()
+}
+
+
+func (s EncryptedStore) Get(name string) ([]byte, error) {
+	rc, err := s.NewReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+
+func (s EncryptedStore) Exists(name string) (bool, error) {
+	return s.Inner.Exists(name)
+}
+
+
+func (s EncryptedStore) List(prefix string) ([]string, error) {
+	return s.Inner.List(prefix)
+}
+
+
+func (s EncryptedStore) Delete(name string) error {
+	return s.Inner.Delete(name)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+
+func newTestEncryptedStore(t *testing.T, dirPath string) EncryptedStore {
+	key, err := newProjectKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewEncryptedStore(LocalStore{dirPath}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+
+// testPlaintext is size bytes that differ from chunk to chunk, so swapped chunks
+// do not decrypt to the same data by chance.
+func testPlaintext(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i / 7)
+	}
+	return data
+}
+
+
+func TestEncryptedStoreRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1,
+		2 * encChunkSize - 1, 2 * encChunkSize, 2 * encChunkSize + 1}
+
+	store := newTestEncryptedStore(t, t.TempDir())
+	for _, size := range sizes {
+		name := fmt.Sprintf("blobs/%d", size)
+		data := testPlaintext(size)
+		if err := store.Put(name, data); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+
+		sealed, err := store.Inner.Get(name)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		// a few bytes can turn up in the ciphertext by chance.
+		if size >= 32 && bytes.Contains(sealed, data) {
+			t.Errorf("%d bytes: the stored object holds the plaintext", size)
+		}
+
+		got, err := store.Get(name)
+		if err != nil {
+			t.Errorf("%d bytes: %v", size, err)
+			continue
+		}
+		if ! bytes.Equal(got, data) {
+			t.Errorf("%d bytes: got %d bytes back that differ", size, len(got))
+		}
+	}
+}
+
+
+func TestEncryptedStoreTampering(t *testing.T) {
+	dirPath := t.TempDir()
+	store := newTestEncryptedStore(t, dirPath)
+	data := testPlaintext(2 * encChunkSize + 100)
+	if err := store.Put("blobs/a", data); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := store.Inner.Get("blobs/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := len(encMagic) + encPrefixSize
+	chunk := encChunkSize + store.aead.Overhead()
+	first, second := sealed[header : header + chunk], sealed[header + chunk : header + 2 * chunk]
+
+	cases := []struct {
+		name string
+		sealed []byte
+	}{
+		{"truncated after a chunk", sealed[: header + chunk]},
+		{"truncated after two chunks", sealed[: header + 2 * chunk]},
+		{"truncated inside a chunk", sealed[: header + chunk + 10]},
+		{"last byte cut", sealed[: len(sealed) - 1]},
+		{"header only", sealed[: header]},
+		{"chunks swapped", concatBytes(sealed[: header], second, first, sealed[header + 2 * chunk :])},
+		{"chunk repeated", concatBytes(sealed[: header], first, first, sealed[header + 2 * chunk :])},
+		{"byte changed", concatBytes(sealed[: header + 5], []byte{sealed[header + 5] ^ 1}, sealed[header + 6 :])},
+	}
+
+	for _, c := range cases {
+		if err := store.Inner.Put("blobs/b", c.sealed); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Get("blobs/b"); err == nil {
+			t.Errorf("%s: decrypted without an error", c.name)
+		}
+	}
+
+	// the name is bound to the object, so a copy under another name fails too.
+	if err := store.Inner.Put("blobs/b", sealed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("blobs/b"); err == nil {
+		t.Error("renamed object: decrypted without an error")
+	}
+	if _, err := store.Get("blobs/a"); err != nil {
+		t.Errorf("untouched object: %v", err)
+	}
+}
+
+
+func TestEncryptedStoreWrongKey(t *testing.T) {
+	dirPath := t.TempDir()
+	store := newTestEncryptedStore(t, dirPath)
+	other := newTestEncryptedStore(t, dirPath)
+	if other.blobID("abc") == store.blobID("abc") {
+		t.Error("blob names do not depend on the key")
+	}
+	for _, size := range []int{10, 2 * encChunkSize + 10} {
+		name := fmt.Sprintf("blobs/%d", size)
+		if err := store.Put(name, testPlaintext(size)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.Get(name); err == nil {
+			t.Errorf("%d bytes: decrypted with another key", size)
+		}
+	}
+}
+
+
+func concatBytes(parts ...[]byte) []byte {
+	var all []byte
+	for _, part := range parts {
+		all = append(all, part...)
+	}
+	return all
+}
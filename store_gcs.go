@@ -0,0 +1,211 @@
+package main
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+
+// GCSStore keeps a project in a Google Cloud Storage bucket.
+type GCSStore struct {
+	BucketName string
+	SAKPath string
+}
+
+
+func (s GCSStore) Put(name string, data []byte) error {
+	ctx := context.Background()
+	client, err := getGCSClient(s.BucketName, s.SAKPath)
+	if err != nil {
+		return err
+	}
+
+	wc := client.Bucket(s.BucketName).Object(name).NewWriter(ctx)
+	if _, err := wc.Write(data); err != nil {
+		wc.Close()
+		return errors.Wrap(err, "storage error")
+	}
+	if err := wc.Close(); err != nil {
+		return errors.Wrap(err, "storage error")
+	}
+	return nil
+}
+
+
+func (s GCSStore) Get(name string) ([]byte, error) {
+	ctx := context.Background()
+	client, err := getGCSClient(s.BucketName, s.SAKPath)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := client.Bucket(s.BucketName).Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "storage error")
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Wrap(err, "storage error")
+	}
+	return data, nil
+}
+
+
+func (s GCSStore) Exists(name string) (bool, error) {
+	ctx := context.Background()
+	client, err := getGCSClient(s.BucketName, s.SAKPath)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = client.Bucket(s.BucketName).Object(name).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "storage error")
+	}
+	return true, nil
+}
+
+
+func (s GCSStore) List(prefix string) ([]string, error) {
+	ctx := context.Background()
+	client, err := getGCSClient(s.BucketName, s.SAKPath)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	it := client.Bucket(s.BucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "storage error")
+		}
+		names = append(names, attrs.Name)
+	}
+	return names, nil
+}
+
+
+func (s GCSStore) Delete(name string) error {
+	ctx := context.Background()
+	client, err := getGCSClient(s.BucketName, s.SAKPath)
+	if err != nil {
+		return err
+	}
+
+	err = client.Bucket(s.BucketName).Object(name).Delete(ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return errors.Wrap(err, "storage error")
+	}
+	return nil
+}
+
+
+type gcsObjectWriter struct {
+	*storage.Writer
+	cancel context.CancelFunc
+}
+
+
+func (w gcsObjectWriter) Close() error {
+	defer w.cancel()
+	if err := w.Writer.Close(); err != nil {
+		return errors.Wrap(err, "storage error")
+	}
+	return nil
+}
+
+
+func (w gcsObjectWriter) Abort() {
+	// cancelling the context before Close stops the object from being created.
+	w.cancel()
+	w.Writer.Close()
+}
+
+
+func (s GCSStore) NewWriter(name string) (ObjectWriter, error) {
+	client, err := getGCSClient(s.BucketName, s.SAKPath)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return gcsObjectWriter{client.Bucket(s.BucketName).Object(name).NewWriter(ctx), cancel}, nil
+}
+
+
+func (s GCSStore) NewReader(name string) (io.ReadCloser, error) {
+	client, err := getGCSClient(s.BucketName, s.SAKPath)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := client.Bucket(s.BucketName).Object(name).NewReader(context.Background())
+	if err != nil {
+		return nil, errors.Wrap(err, "storage error")
+	}
+	return rc, nil
+}
+
+
+func (s GCSStore) GetWithVersion(name string) ([]byte, string, error) {
+	client, err := getGCSClient(s.BucketName, s.SAKPath)
+	if err != nil {
+		return nil, "", err
+	}
+	rc, err := client.Bucket(s.BucketName).Object(name).NewReader(context.Background())
+	if err == storage.ErrObjectNotExist {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", errors.Wrap(err, "storage error")
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "storage error")
+	}
+	return data, strconv.FormatInt(rc.Attrs.Generation, 10), nil
+}
+
+
+func (s GCSStore) PutIfVersion(name string, data []byte, version string) error {
+	client, err := getGCSClient(s.BucketName, s.SAKPath)
+	if err != nil {
+		return err
+	}
+
+	conds := storage.Conditions{DoesNotExist: true}
+	if version != "" {
+		generation, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return errors.Wrap(err, "strconv error")
+		}
+		conds = storage.Conditions{GenerationMatch: generation}
+	}
+
+	wc := client.Bucket(s.BucketName).Object(name).If(conds).NewWriter(context.Background())
+	if _, err := wc.Write(data); err != nil {
+		wc.Close()
+		return errors.Wrap(err, "storage error")
+	}
+	err = wc.Close()
+	if gErr, ok := err.(*googleapi.Error); ok && gErr.Code == http.StatusPreconditionFailed {
+		return ErrVersionMismatch
+	}
+	if err != nil {
+		return errors.Wrap(err, "storage error")
+	}
+	return nil
+}
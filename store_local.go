@@ -0,0 +1,258 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+
+// LocalStore keeps a project in a directory, usually a shared mount. Every
+// object is a file at the object's name relative to the directory.
+type LocalStore struct {
+	DirPath string
+}
+
+
+func (s LocalStore) objectPath(name string) string {
+	return filepath.Join(s.DirPath, filepath.FromSlash(name))
+}
+
+
+// checkReachable fails when the project directory is gone, which is what an
+// unmounted share looks like. Writing then would create the objects on the
+// local disk instead.
+func (s LocalStore) checkReachable() error {
+	fi, err := os.Stat(s.DirPath)
+	if err != nil || ! fi.IsDir() {
+		return errors.Wrap(ErrStoreUnreachable, s.DirPath)
+	}
+	return nil
+}
+
+
+func (s LocalStore) Put(name string, data []byte) error {
+	if err := s.checkReachable(); err != nil {
+		return err
+	}
+	p := s.objectPath(name)
+	err := os.MkdirAll(filepath.Dir(p), 0777)
+	if err != nil {
+		return errors.Wrap(err, "os error")
+	}
+
+	// write to a temporary file first so that other members never read a half
+	// written object.
+	tmpPath := p + ".flotmp" + UntestedRandomString(6)
+	err = os.WriteFile(tmpPath, data, 0777)
+	if err != nil {
+		return errors.Wrap(err, "os error")
+	}
+	err = os.Rename(tmpPath, p)
+	if err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "os error")
+	}
+	return nil
+}
+
+
+func (s LocalStore) Get(name string) ([]byte, error) {
+	if err := s.checkReachable(); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(s.objectPath(name))
+	if err != nil {
+		return nil, errors.Wrap(err, "os error")
+	}
+	return data, nil
+}
+
+
+func (s LocalStore) Exists(name string) (bool, error) {
+	if err := s.checkReachable(); err != nil {
+		return false, err
+	}
+	_, err := os.Stat(s.objectPath(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "os error")
+	}
+	return true, nil
+}
+
+
+func (s LocalStore) List(prefix string) ([]string, error) {
+	if err := s.checkReachable(); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	// only walk the directory the prefix points into.
+	startPath := s.DirPath
+	if i := strings.LastIndex(prefix, "/"); i != -1 {
+		startPath = s.objectPath(prefix[: i])
+	}
+	if ! DoesPathExists(startPath) {
+		return names, nil
+	}
+
+	err := filepath.Walk(startPath, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.Contains(info.Name(), ".flotmp") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.DirPath, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "filepath error")
+	}
+	return names, nil
+}
+
+
+func (s LocalStore) Delete(name string) error {
+	if err := s.checkReachable(); err != nil {
+		return err
+	}
+	err := os.Remove(s.objectPath(name))
+	if err != nil && ! os.IsNotExist(err) {
+		return errors.Wrap(err, "os error")
+	}
+	return nil
+}
+
+
+type localObjectWriter struct {
+	f *os.File
+	finalPath string
+}
+
+
+func (w localObjectWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+
+func (w localObjectWriter) Close() error {
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return errors.Wrap(err, "os error")
+	}
+	if err := os.Rename(w.f.Name(), w.finalPath); err != nil {
+		os.Remove(w.f.Name())
+		return errors.Wrap(err, "os error")
+	}
+	return nil
+}
+
+
+func (w localObjectWriter) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+
+func (s LocalStore) NewWriter(name string) (ObjectWriter, error) {
+	if err := s.checkReachable(); err != nil {
+		return nil, err
+	}
+	p := s.objectPath(name)
+	err := os.MkdirAll(filepath.Dir(p), 0777)
+	if err != nil {
+		return nil, errors.Wrap(err, "os error")
+	}
+	f, err := os.Create(p + ".flotmp" + UntestedRandomString(6))
+	if err != nil {
+		return nil, errors.Wrap(err, "os error")
+	}
+	return localObjectWriter{f, p}, nil
+}
+
+
+func (s LocalStore) NewReader(name string) (io.ReadCloser, error) {
+	if err := s.checkReachable(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.objectPath(name))
+	if err != nil {
+		return nil, errors.Wrap(err, "os error")
+	}
+	return f, nil
+}
+
+
+func (s LocalStore) GetWithVersion(name string) ([]byte, string, error) {
+	if err := s.checkReachable(); err != nil {
+		return nil, "", err
+	}
+	data, err := os.ReadFile(s.objectPath(name))
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", errors.Wrap(err, "os error")
+	}
+	return data, hashBytes(data), nil
+}
+
+
+// PutIfVersion holds a lock file next to the object while it compares and
+// writes, so members sharing the directory cannot interleave.
+func (s LocalStore) PutIfVersion(name string, data []byte, version string) error {
+	if err := s.checkReachable(); err != nil {
+		return err
+	}
+	p := s.objectPath(name)
+	err := os.MkdirAll(filepath.Dir(p), 0777)
+	if err != nil {
+		return errors.Wrap(err, "os error")
+	}
+
+	lockPath := p + ".flotmplock"
+	for i := 0; ; i++ {
+		lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0777)
+		if err == nil {
+			lockFile.Close()
+			break
+		}
+		if ! os.IsExist(err) {
+			return errors.Wrap(err, "os error")
+		}
+		// a lock this old was left by a program that died.
+		if fi, err := os.Stat(lockPath); err == nil && time.Since(fi.ModTime()) > 30 * time.Second {
+			os.Remove(lockPath)
+			continue
+		}
+		if i == 100 {
+			return errors.New("timed out waiting for the lock on " + name)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	defer os.Remove(lockPath)
+
+	_, currentVersion, err := s.GetWithVersion(name)
+	if err != nil {
+		return err
+	}
+	if currentVersion != version {
+		return ErrVersionMismatch
+	}
+	return s.Put(name, data)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+
+const (
+	DefaultRetryAttempts = 4
+	DefaultRetryDelayMS = 300
+	maxRetryDelay = 30 * time.Second
+)
+
+
+// RetryPolicy is how often and how patiently a failed storage operation is tried
+// again. The wait doubles after every failed attempt.
+type RetryPolicy struct {
+	Attempts int
+	BaseDelay time.Duration
+}
+
+
+// getRetryPolicy reads the policy from the settings.
+func getRetryPolicy() RetryPolicy {
+	policy := RetryPolicy{DefaultRetryAttempts, DefaultRetryDelayMS * time.Millisecond}
+	settings, err := getSettings()
+	if err != nil {
+		return policy
+	}
+	if attempts, err := strconv.Atoi(settings["retry_attempts"]); err == nil && attempts > 0 {
+		policy.Attempts = attempts
+	}
+	if delayMS, err := strconv.Atoi(settings["retry_delay_ms"]); err == nil && delayMS >= 0 {
+		policy.BaseDelay = time.Duration(delayMS) * time.Millisecond
+	}
+	return policy
+}
+
+
+// Do runs op until it succeeds, fails with an error that is not transient or
+// runs out of attempts.
+func (p RetryPolicy) Do(op func() error) error {
+	delay := p.BaseDelay
+	var err error
+	for i := 0; i < p.Attempts; i++ {
+		err = op()
+		if err == nil || ! isTransientError(err) {
+			return err
+		}
+		if i < p.Attempts - 1 {
+			time.Sleep(delay)
+			delay *= 2
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
+	}
+	return err
+}
+
+
+// isTransientError reports if trying again could make an operation succeed:
+// network failures, timeouts, throttling and server errors.
+func isTransientError(err error) bool {
+	if err == nil || errors.Is(err, ErrVersionMismatch) || errors.Is(err, ErrStoreUnreachable) {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	isTransientStatus := func(code int) bool {
+		return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+	}
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return isTransientStatus(gErr.Code)
+	}
+	var s3Err minio.ErrorResponse
+	if errors.As(err, &s3Err) {
+		return isTransientStatus(s3Err.StatusCode)
+	}
+	return false
+}
+
+
+// RetryStore tries the operations of another store again when they fail with a
+// transient error. Streams cannot be picked up where they broke off, so for
+// NewReader and NewWriter only the opening is retried; callers retry a whole
+// stream with the policy, which is cheap as blobs are never bigger than ChunkSize.
+type RetryStore struct {
+	Inner Store
+	Policy RetryPolicy
+}
+
+
+func (s RetryStore) Put(name string, data []byte) error {
+	return s.Policy.Do(func() error {
+		return s.Inner.Put(name, data)
+	})
+}
+
+
+func (s RetryStore) Get(name string) ([]byte, error) {
+	var data []byte
+	err := s.Policy.Do(func() error {
+		var err error
+		data, err = s.Inner.Get(name)
+		return err
+	})
+	return data, err
+}
+
+
+func (s RetryStore) Exists(name string) (bool, error) {
+	var status bool
+	err := s.Policy.Do(func() error {
+		var err error
+		status, err = s.Inner.Exists(name)
+		return err
+	})
+	return status, err
+}
+
+
+func (s RetryStore) List(prefix string) ([]string, error) {
+	var names []string
+	err := s.Policy.Do(func() error {
+		var err error
+		names, err = s.Inner.List(prefix)
+		return err
+	})
+	return names, err
+}
+
+
+func (s RetryStore) Delete(name string) error {
+	return s.Policy.Do(func() error {
+		return s.Inner.Delete(name)
+	})
+}
+
+
+func (s RetryStore) NewReader(name string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := s.Policy.Do(func() error {
+		var err error
+		rc, err = s.Inner.NewReader(name)
+		return err
+	})
+	return rc, err
+}
+
+
+func (s RetryStore) NewWriter(name string) (ObjectWriter, error) {
+	var wc ObjectWriter
+	err := s.Policy.Do(func() error {
+		var err error
+		wc, err = s.Inner.NewWriter(name)
+		return err
+	})
+	return wc, err
+}
+
+
+func (s RetryStore) GetWithVersion(name string) ([]byte, string, error) {
+	var data []byte
+	var version string
+	err := s.Policy.Do(func() error {
+		var err error
+		data, version, err = s.Inner.GetWithVersion(name)
+		return err
+	})
+	return data, version, err
+}
+
+
+// PutIfVersion may have been applied by an attempt whose reply was lost, so a
+// retry can see ErrVersionMismatch for its own write. updateManifest then reads
+// the manifest again and its edits treat an entry already there as done.
+func (s RetryStore) PutIfVersion(name string, data []byte, version string) error {
+	return s.Policy.Do(func() error {
+		return s.Inner.PutIfVersion(name, data, version)
+	})
+}
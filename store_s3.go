@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+)
+
+
+// S3Store keeps a project in a bucket of any S3 compatible service
+// (AWS, MinIO, Ceph, Backblaze).
+type S3Store struct {
+	Endpoint string
+	BucketName string
+	AccessKey string
+	SecretKey string
+	Region string
+	PathStyle bool
+}
+
+
+func (s S3Store) newClient() (*minio.Client, error) {
+	// the endpoint may be written with a scheme. Plain http is mostly for a MinIO
+	// running on the same machine.
+	endpoint := s.Endpoint
+	secure := true
+	if strings.HasPrefix(endpoint, "http://") {
+		secure = false
+	}
+	endpoint = strings.TrimPrefix(strings.TrimPrefix(endpoint, "http://"), "https://")
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	lookup := minio.BucketLookupAuto
+	if s.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewStaticV4(s.AccessKey, s.SecretKey, ""),
+		Secure: secure,
+		Region: s.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "s3 error")
+	}
+	return client, nil
+}
+
+
+func isS3NotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+
+func (s S3Store) Put(name string, data []byte) error {
+	client, err := getS3Client(s)
+	if err != nil {
+		return err
+	}
+	_, err = client.PutObject(context.Background(), s.BucketName, name, bytes.NewReader(data),
+		int64(len(data)), minio.PutObjectOptions{})
+	if err != nil {
+		return errors.Wrap(err, "s3 error")
+	}
+	return nil
+}
+
+
+func (s S3Store) Get(name string) ([]byte, error) {
+	client, err := getS3Client(s)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := client.GetObject(context.Background(), s.BucketName, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "s3 error")
+	}
+	defer obj.Close()
+
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		return nil, errors.Wrap(err, "s3 error")
+	}
+	return data, nil
+}
+
+
+func (s S3Store) Exists(name string) (bool, error) {
+	client, err := getS3Client(s)
+	if err != nil {
+		return false, err
+	}
+	_, err = client.StatObject(context.Background(), s.BucketName, name, minio.StatObjectOptions{})
+	if err != nil {
+		if isS3NotFound(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "s3 error")
+	}
+	return true, nil
+}
+
+
+func (s S3Store) List(prefix string) ([]string, error) {
+	client, err := getS3Client(s)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	objCh := client.ListObjects(context.Background(), s.BucketName, minio.ListObjectsOptions{
+		Prefix: prefix,
+		Recursive: true,
+	})
+	for objInfo := range objCh {
+		if objInfo.Err != nil {
+			return nil, errors.Wrap(objInfo.Err, "s3 error")
+		}
+		names = append(names, objInfo.Key)
+	}
+	return names, nil
+}
+
+
+func (s S3Store) Delete(name string) error {
+	client, err := getS3Client(s)
+	if err != nil {
+		return err
+	}
+	err = client.RemoveObject(context.Background(), s.BucketName, name, minio.RemoveObjectOptions{})
+	if err != nil && ! isS3NotFound(err) {
+		return errors.Wrap(err, "s3 error")
+	}
+	return nil
+}
+
+
+// s3ObjectWriter feeds a multipart upload running in another goroutine.
+type s3ObjectWriter struct {
+	pw *io.PipeWriter
+	done chan error
+}
+
+
+func (w s3ObjectWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+
+func (w s3ObjectWriter) Close() error {
+	w.pw.Close()
+	if err := <-w.done; err != nil {
+		return errors.Wrap(err, "s3 error")
+	}
+	return nil
+}
+
+
+func (w s3ObjectWriter) Abort() {
+	w.pw.CloseWithError(errors.New("upload aborted"))
+	<-w.done
+}
+
+
+func (s S3Store) NewWriter(name string) (ObjectWriter, error) {
+	client, err := getS3Client(s)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		// the size is unknown so minio buffers one part at a time.
+		_, err := client.PutObject(context.Background(), s.BucketName, name, pr, -1,
+			minio.PutObjectOptions{PartSize: 16 * 1024 * 1024})
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	return s3ObjectWriter{pw, done}, nil
+}
+
+
+func (s S3Store) NewReader(name string) (io.ReadCloser, error) {
+	client, err := getS3Client(s)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := client.GetObject(context.Background(), s.BucketName, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "s3 error")
+	}
+	return obj, nil
+}
+
+
+func (s S3Store) GetWithVersion(name string) ([]byte, string, error) {
+	client, err := getS3Client(s)
+	if err != nil {
+		return nil, "", err
+	}
+	obj, err := client.GetObject(context.Background(), s.BucketName, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, "", errors.Wrap(err, "s3 error")
+	}
+	defer obj.Close()
+
+	info, err := obj.Stat()
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, "", nil
+		}
+		return nil, "", errors.Wrap(err, "s3 error")
+	}
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "s3 error")
+	}
+	return data, info.ETag, nil
+}
+
+
+// PutIfVersion sends the version as an If-Match precondition, or If-None-Match: *
+// when the object must not exist, so the check and the write are one request.
+// A server that does not support conditional writes refuses the write.
+func (s S3Store) PutIfVersion(name string, data []byte, version string) error {
+	client, err := getS3Client(s)
+	if err != nil {
+		return err
+	}
+
+	opts := minio.PutObjectOptions{}
+	if version == "" {
+		opts.SetMatchETagExcept("*")
+	} else {
+		opts.SetMatchETag(version)
+	}
+	_, err = client.PutObject(context.Background(), s.BucketName, name, bytes.NewReader(data),
+		int64(len(data)), opts)
+	if err != nil {
+		switch minio.ToErrorResponse(err).Code {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return ErrVersionMismatch
+		case "NotImplemented":
+			return errors.New("the s3 storage does not support conditional writes, which manifests need")
+		}
+		return errors.Wrap(err, "s3 error")
+	}
+	return nil
+}
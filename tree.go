@@ -0,0 +1,515 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+
+// A snapshot is saved as a tree object at <email>/<snapshot>.tree.json which
+// lists every file with the SHA-256 of its contents. The contents are saved once
+// per project as gzipped blobs at blobs/<sha256> (named by blobName in encrypted
+// projects), so files that do not change between snapshots are never uploaded
+// again.
+//
+// Files bigger than ChunkSize are saved as one blob per ChunkSize piece, listed
+// in Chunks. An upload that broke off is then picked up at the first piece the
+// store does not have.
+type TreeEntry struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+	Size int64 `json:"size"`
+	Mode uint32 `json:"mode"`
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+const ChunkSize = 8 * 1024 * 1024
+
+var ErrFileChanged = errors.New("a file was changed while the snapshot was being made. Please try again.")
+
+type BlobRef struct {
+	Hash string
+	Size int64
+}
+
+
+// blobs returns the blobs holding the file's contents in order.
+func (entry TreeEntry) blobs() []BlobRef {
+	if len(entry.Chunks) == 0 {
+		return []BlobRef{{entry.Hash, entry.Size}}
+	}
+	refs := make([]BlobRef, 0, len(entry.Chunks))
+	for i, chunkHash := range entry.Chunks {
+		size := int64(ChunkSize)
+		if i == len(entry.Chunks) - 1 {
+			size = entry.Size - int64(i) * ChunkSize
+		}
+		refs = append(refs, BlobRef{chunkHash, size})
+	}
+	return refs
+}
+
+type SnapshotTree struct {
+	Files []TreeEntry `json:"files"`
+}
+
+
+func snapshotTreeName(email, snapshotName string) string {
+	return email + "/" + snapshotName + ".tree.json"
+}
+
+
+func snapshotArchiveName(email, snapshotName string) string {
+	return email + "/" + snapshotName + ".tar.gz"
+}
+
+
+// blobName returns the name of the blob of the contents whose SHA-256 is hash.
+// Encrypted projects name blobs by an HMAC instead.
+func blobName(store Store, hash string) string {
+	if es, ok := store.(EncryptedStore); ok {
+		return "blobs/" + es.blobID(hash)
+	}
+	return plainBlobName(hash)
+}
+
+
+// plainBlobName is the name of a blob in plain projects and of the blobs that
+// encrypted projects saved before blobs were named by an HMAC.
+func plainBlobName(hash string) string {
+	return "blobs/" + hash
+}
+
+
+func hashBytes(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+
+// hashFileChunks returns the SHA-256 of a file and, when it is bigger than
+// ChunkSize, the SHA-256 of each of its pieces.
+func hashFileChunks(path string) (string, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "os error")
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	chunks := make([]string, 0)
+	buf := make([]byte, ChunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			h.Write(buf[: n])
+			chunks = append(chunks, hashBytes(buf[: n]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", nil, errors.Wrap(err, "os error")
+		}
+	}
+	if len(chunks) < 2 {
+		chunks = nil
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), chunks, nil
+}
+
+
+// uploadBlob saves the contents read from r as the blob of hash. The contents are
+// hashed as they are sent and the blob is thrown away if they do not match, as
+// happens when a file is changed while a snapshot is made.
+func uploadBlob(store Store, hash string, r io.Reader) error {
+	wc, err := store.NewWriter(blobName(store, hash))
+	if err != nil {
+		return err
+	}
+	gzw := gzip.NewWriter(wc)
+	h := sha256.New()
+	_, err = io.Copy(gzw, io.TeeReader(r, h))
+	if err == nil {
+		err = gzw.Close()
+	}
+	if err != nil {
+		wc.Abort()
+		return errors.Wrap(err, "gzip error")
+	}
+	if fmt.Sprintf("%x", h.Sum(nil)) != hash {
+		wc.Abort()
+		return ErrFileChanged
+	}
+	return wc.Close()
+}
+
+
+// uploadFileBlobs uploads the blobs of a file that the store does not have,
+// trying each again on transient failures.
+func uploadFileBlobs(store Store, path string, entry TreeEntry, haveBlobs map[string]bool) error {
+	policy := getRetryPolicy()
+	for i, ref := range entry.blobs() {
+		if haveBlobs[blobName(store, ref.Hash)] || haveBlobs[plainBlobName(ref.Hash)] {
+			continue
+		}
+		offset := int64(i) * ChunkSize
+		err := policy.Do(func() error {
+			f, err := os.Open(path)
+			if err != nil {
+				return errors.Wrap(err, "os error")
+			}
+			defer f.Close()
+			return uploadBlob(store, ref.Hash, io.NewSectionReader(f, offset, ref.Size))
+		})
+		if err != nil {
+			return err
+		}
+		haveBlobs[blobName(store, ref.Hash)] = true
+	}
+	return nil
+}
+
+
+// uploadSnapshotTree saves the files (absolute paths under basePath) as a snapshot,
+// only uploading the blobs the store does not already have. It returns the
+// SHA-256 and size of the tree object for the manifest.
+func uploadSnapshotTree(store Store, email, snapshotName, basePath string, files []string) (string, int64, error) {
+	markerName := uploadMarkerName(email, snapshotName)
+	err := putMarker(store, markerName)
+	if err != nil {
+		return "", 0, err
+	}
+	defer store.Delete(markerName)
+	cleanupRunning, err := isLiveMarker(store, gcMarkerName)
+	if err != nil {
+		return "", 0, err
+	}
+	if cleanupRunning {
+		return "", 0, ErrCleanupRunning
+	}
+
+	blobNames, err := store.List("blobs/")
+	if err != nil {
+		return "", 0, err
+	}
+	haveBlobs := make(map[string]bool)
+	for _, name := range blobNames {
+		haveBlobs[name] = true
+	}
+
+	tree := SnapshotTree{make([]TreeEntry, 0)}
+	for _, p := range files {
+		rel, err := filepath.Rel(basePath, p)
+		if err != nil {
+			return "", 0, errors.Wrap(err, "filepath error")
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return "", 0, errors.Wrap(err, "os error")
+		}
+		hash, chunks, err := hashFileChunks(p)
+		if err != nil {
+			return "", 0, err
+		}
+
+		entry := TreeEntry{filepath.ToSlash(rel), hash, fi.Size(), uint32(fi.Mode().Perm()), chunks}
+		err = uploadFileBlobs(store, p, entry, haveBlobs)
+		if err != nil {
+			return "", 0, err
+		}
+		tree.Files = append(tree.Files, entry)
+	}
+
+	jsonBytes, err := json.Marshal(tree)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "json error")
+	}
+	err = store.Put(snapshotTreeName(email, snapshotName), jsonBytes)
+	if err != nil {
+		return "", 0, err
+	}
+	return hashBytes(jsonBytes), int64(len(jsonBytes)), nil
+}
+
+
+// getSnapshotTree reads a tree object, checking it against the hash recorded in
+// the manifest. Manifest entries made before hashes were recorded have none.
+func getSnapshotTree(store Store, email, snapshotName, expectedHash string) (SnapshotTree, error) {
+	raw, err := store.Get(snapshotTreeName(email, snapshotName))
+	if err != nil {
+		return SnapshotTree{}, err
+	}
+	if expectedHash != "" && hashBytes(raw) != expectedHash {
+		return SnapshotTree{}, errors.New("snapshot " + snapshotName + " of " + email + " is corrupted: hash mismatch")
+	}
+	var tree SnapshotTree
+	err = json.Unmarshal(raw, &tree)
+	if err != nil {
+		return SnapshotTree{}, errors.Wrap(err, "json error")
+	}
+	return tree, nil
+}
+
+
+// readBlob streams a blob's contents into w and confirms the contents match the
+// blob's hash and the expected size.
+func readBlob(store Store, hash string, size int64, w io.Writer) error {
+	rc, err := store.NewReader(blobName(store, hash))
+	if err != nil && blobName(store, hash) != plainBlobName(hash) {
+		// the blob may have been saved under its plain name.
+		if exists, existsErr := store.Exists(blobName(store, hash)); existsErr == nil && ! exists {
+			rc, err = store.NewReader(plainBlobName(hash))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	gzr, err := gzip.NewReader(rc)
+	if err != nil {
+		return errors.Wrap(err, "gzip error")
+	}
+	defer gzr.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), gzr)
+	if err != nil {
+		return errors.Wrap(err, "gzip error")
+	}
+	if n != size || fmt.Sprintf("%x", h.Sum(nil)) != hash {
+		return errors.New("blob " + hash + " is corrupted")
+	}
+	return nil
+}
+
+
+// readEntry streams a file's contents into w, joining its pieces when it was
+// saved in chunks.
+func readEntry(store Store, entry TreeEntry, w io.Writer) error {
+	if len(entry.Chunks) == 0 {
+		return readBlob(store, entry.Hash, entry.Size, w)
+	}
+	h := sha256.New()
+	for _, ref := range entry.blobs() {
+		err := readBlob(store, ref.Hash, ref.Size, io.MultiWriter(w, h))
+		if err != nil {
+			return err
+		}
+	}
+	if fmt.Sprintf("%x", h.Sum(nil)) != entry.Hash {
+		return errors.New("file " + entry.Path + " is corrupted")
+	}
+	return nil
+}
+
+
+// downloadBlob writes a file of a tree to outPath. A transient failure starts the
+// file over.
+func downloadBlob(store Store, entry TreeEntry, outPath string) error {
+	err := os.MkdirAll(filepath.Dir(outPath), 0777)
+	if err != nil {
+		return errors.Wrap(err, "os error")
+	}
+	err = getRetryPolicy().Do(func() error {
+		f, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(entry.Mode) | 0600)
+		if err != nil {
+			return errors.Wrap(err, "os error")
+		}
+		err = readEntry(store, entry, f)
+		f.Close()
+		return err
+	})
+	if err != nil {
+		os.Remove(outPath)
+		return err
+	}
+	return nil
+}
+
+
+// downloadSnapshot unpacks a snapshot of any format into a fresh directory at
+// destPath, verifying everything it downloads. expectedHash is the snapshot_hash
+// of the snapshot's manifest entry.
+func downloadSnapshot(store Store, email, snapshotName, expectedHash, destPath string) error {
+	treeStatus, err := store.Exists(snapshotTreeName(email, snapshotName))
+	if err != nil {
+		return err
+	}
+	if ! treeStatus {
+		return downloadSnapshotArchive(store, snapshotArchiveName(email, snapshotName), expectedHash, destPath)
+	}
+
+	tree, err := getSnapshotTree(store, email, snapshotName, expectedHash)
+	if err != nil {
+		return err
+	}
+	os.RemoveAll(destPath)
+	err = os.MkdirAll(destPath, 0777)
+	if err != nil {
+		return errors.Wrap(err, "os error")
+	}
+	for _, entry := range tree.Files {
+		outPath := filepath.Join(destPath, filepath.FromSlash(entry.Path))
+		if ! strings.HasPrefix(outPath, destPath + string(filepath.Separator)) {
+			return errors.New("illegal path in snapshot tree: " + entry.Path)
+		}
+		err = downloadBlob(store, entry, outPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+
+// copySnapshot saves an existing snapshot under a new name. For trees only the
+// tree object is copied.
+func copySnapshot(store Store, fromEmail, fromName, toEmail, toName string) error {
+	treeStatus, err := store.Exists(snapshotTreeName(fromEmail, fromName))
+	if err != nil {
+		return err
+	}
+	if treeStatus {
+		return copyObject(store, snapshotTreeName(fromEmail, fromName), snapshotTreeName(toEmail, toName))
+	}
+	return copyObject(store, snapshotArchiveName(fromEmail, fromName), snapshotArchiveName(toEmail, toName))
+}
+
+
+// deleteSnapshot removes the snapshot's tree or archive. Blobs are left alone
+// since other snapshots may share them; collectGarbage removes the unused ones.
+func deleteSnapshot(store Store, email, snapshotName string) error {
+	err := store.Delete(snapshotTreeName(email, snapshotName))
+	if err != nil {
+		return err
+	}
+	return store.Delete(snapshotArchiveName(email, snapshotName))
+}
+
+
+// An upload reuses the blobs it finds in the store, so unused blobs are never
+// removed while one runs. Each upload keeps a marker at uploads/<email>/<snapshot>
+// for as long as it runs and a clean up keeps one at gc/marker. Both write their
+// marker before looking for the other's and back off when they find one. Markers
+// older than staleMarkerAge were left by runs that crashed and are ignored.
+const staleMarkerAge = 24 * time.Hour
+
+const gcMarkerName = "gc/marker"
+
+var ErrCleanupRunning = errors.New("unused files are being removed from the storage. Please try again in a moment.")
+
+var ErrUploadRunning = errors.New("a snapshot is being uploaded")
+
+
+func uploadMarkerName(email, snapshotName string) string {
+	return "uploads/" + email + "/" + snapshotName
+}
+
+
+func putMarker(store Store, name string) error {
+	return store.Put(name, []byte(time.Now().UTC().Format(time.RFC3339)))
+}
+
+
+// isLiveMarker reports if the marker of that name exists and is not stale.
+func isLiveMarker(store Store, name string) (bool, error) {
+	exists, err := store.Exists(name)
+	if err != nil || ! exists {
+		return false, err
+	}
+	raw, err := store.Get(name)
+	if err != nil {
+		// the run may have just finished.
+		exists, existsErr := store.Exists(name)
+		if existsErr == nil && ! exists {
+			return false, nil
+		}
+		return false, err
+	}
+	markedAt, err := time.Parse(time.RFC3339, string(raw))
+	return err == nil && time.Since(markedAt) < staleMarkerAge, nil
+}
+
+
+// liveMarkers returns the markers whose name begins with prefix that are not stale.
+func liveMarkers(store Store, prefix string) ([]string, error) {
+	names, err := store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	live := make([]string, 0)
+	for _, name := range names {
+		isLive, err := isLiveMarker(store, name)
+		if err != nil {
+			return nil, err
+		}
+		if isLive {
+			live = append(live, name)
+		}
+	}
+	return live, nil
+}
+
+
+// collectGarbage removes the blobs that no tree of any member uses and returns
+// how many it removed. It returns ErrUploadRunning, removing nothing, while a
+// snapshot is being uploaded.
+func collectGarbage(store Store) (int, error) {
+	err := putMarker(store, gcMarkerName)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Delete(gcMarkerName)
+	uploads, err := liveMarkers(store, "uploads/")
+	if err != nil {
+		return 0, err
+	}
+	if len(uploads) > 0 {
+		return 0, ErrUploadRunning
+	}
+
+	allNames, err := store.List("")
+	if err != nil {
+		return 0, err
+	}
+	used := make(map[string]bool)
+	for _, name := range allNames {
+		i := strings.Index(name, "/")
+		if i == -1 || ! strings.HasSuffix(name, ".tree.json") || strings.HasPrefix(name, "uploads/") {
+			continue
+		}
+		email := name[: i]
+		snapshotName := strings.TrimSuffix(name[i + 1 :], ".tree.json")
+		// a tree that cannot be read could use any blob, so nothing is removed.
+		tree, err := getSnapshotTree(store, email, snapshotName, "")
+		if err != nil {
+			return 0, err
+		}
+		for _, entry := range tree.Files {
+			for _, ref := range entry.blobs() {
+				used[blobName(store, ref.Hash)] = true
+				used[plainBlobName(ref.Hash)] = true
+			}
+		}
+	}
+
+	removed := 0
+	for _, name := range allNames {
+		if strings.HasPrefix(name, "blobs/") && ! used[name] {
+			err = store.Delete(name)
+			if err != nil {
+				return removed, err
+			}
+			removed += 1
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/otiai10/copy"
+	"github.com/pkg/errors"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+
+// workingTreeChanges returns the files of the project folder that were added,
+// changed or deleted since the snapshot unpacked at snapshotPath, sorted.
+func workingTreeChanges(projectName, snapshotPath string) ([]string, error) {
+	rootPath, _ := GetRootPath()
+	projectPath := filepath.Join(rootPath, "p", projectName)
+
+	files, err := getCleanFilesList(projectName)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]string, 0)
+	inWorkingTree := make(map[string]bool)
+	for _, p := range files {
+		shortPath := strings.Replace(p, projectPath + "/", "", 1)
+		inWorkingTree[shortPath] = true
+		rawNew, err := os.ReadFile(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "os error")
+		}
+		rawOld, inSnapshot, err := readMergeFile(snapshotPath, shortPath)
+		if err != nil {
+			return nil, err
+		}
+		if ! inSnapshot || ! bytes.Equal(rawNew, rawOld) {
+			changes = append(changes, shortPath)
+		}
+	}
+
+	oldFiles, err := getAllFilesList(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range oldFiles {
+		shortPath := strings.Replace(p, snapshotPath + "/", "", 1)
+		if ! inWorkingTree[shortPath] {
+			changes = append(changes, shortPath)
+		}
+	}
+	sort.Strings(changes)
+	return changes, nil
+}
+
+
+// copyWorkingTree copies the files of the project folder that snapshots would
+// include to destPath.
+func copyWorkingTree(projectName, destPath string) error {
+	rootPath, _ := GetRootPath()
+	projectPath := filepath.Join(rootPath, "p", projectName)
+	files, err := getCleanFilesList(projectName)
+	if err != nil {
+		return err
+	}
+	for _, p := range files {
+		err = copy.Copy(p, filepath.Join(destPath, strings.Replace(p, projectPath + "/", "", 1)))
+		if err != nil {
+			return errors.Wrap(err, "copy error")
+		}
+	}
+	return nil
+}
+
+
+// workingTreeState returns the SHA-256 of every file of the project folder that
+// snapshots would include.
+func workingTreeState(projectName string) (map[string]string, error) {
+	rootPath, _ := GetRootPath()
+	projectPath := filepath.Join(rootPath, "p", projectName)
+	files, err := getCleanFilesList(projectName)
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[string]string)
+	for _, p := range files {
+		shortPath := strings.Replace(p, projectPath + "/", "", 1)
+		hash, _, err := hashFileChunks(p)
+		if err != nil {
+			return nil, err
+		}
+		state[shortPath] = hash
+	}
+	return state, nil
+}
+
+
+// replaceWorkingTree puts the files of srcPath in the project folder in place of
+// the files snapshots would include. Excluded files are left alone.
+func replaceWorkingTree(projectName, srcPath string) error {
+	rootPath, _ := GetRootPath()
+	projectPath := filepath.Join(rootPath, "p", projectName)
+	files, err := getCleanFilesList(projectName)
+	if err != nil {
+		return err
+	}
+	dirs := make(map[string]bool)
+	for _, p := range files {
+		err = os.Remove(p)
+		if err != nil {
+			return errors.Wrap(err, "os error")
+		}
+		for dir := filepath.Dir(p); dir != projectPath && strings.HasPrefix(dir, projectPath); dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	// folders left empty go too, deepest first.
+	dirList := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		dirList = append(dirList, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirList)))
+	for _, dir := range dirList {
+		os.Remove(dir)
+	}
+
+	err = copy.Copy(srcPath, projectPath)
+	if err != nil {
+		return errors.Wrap(err, "copy error")
+	}
+	return nil
+}
+
+
+// Uncommitted changes put aside before a merger are kept in
+// <root>/stashes/<project>/<name>: a copy of the project folder in files/ and
+// the Stash in stash.json. Applying a stash merges it into the project folder
+// with the snapshot it was made on as the base.
+type Stash struct {
+	Name string `json:"name"`
+	// BaseSnapshot is the user's snapshot the changes were made on.
+	BaseSnapshot string `json:"base_snapshot"`
+	Changes []string `json:"changes"`
+}
+
+
+func getStashesPath(projectName string) string {
+	rootPath, _ := GetRootPath()
+	return filepath.Join(rootPath, "stashes", projectName)
+}
+
+
+func stashWorkingTree(projectName, baseSnapshot string, changes []string) error {
+	stash := Stash{time.Now().Format(VersionFormat), baseSnapshot, changes}
+	stashPath := filepath.Join(getStashesPath(projectName), stash.Name)
+	err := copyWorkingTree(projectName, filepath.Join(stashPath, "files"))
+	if err != nil {
+		os.RemoveAll(stashPath)
+		return err
+	}
+	jsonBytes, err := json.Marshal(stash)
+	if err != nil {
+		return errors.Wrap(err, "json error")
+	}
+	err = os.WriteFile(filepath.Join(stashPath, "stash.json"), jsonBytes, 0777)
+	if err != nil {
+		return errors.Wrap(err, "os error")
+	}
+	return nil
+}
+
+
+// getStashes returns the stashes of a project, newest first.
+func getStashes(projectName string) ([]Stash, error) {
+	stashes := make([]Stash, 0)
+	objFIs, err := os.ReadDir(getStashesPath(projectName))
+	if os.IsNotExist(err) {
+		return stashes, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "os error")
+	}
+	for _, objFI := range objFIs {
+		raw, err := os.ReadFile(filepath.Join(getStashesPath(projectName), objFI.Name(), "stash.json"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "os error")
+		}
+		var stash Stash
+		err = json.Unmarshal(raw, &stash)
+		if err != nil {
+			return nil, errors.Wrap(err, "json error")
+		}
+		stashes = append(stashes, stash)
+	}
+	sort.Slice(stashes, func(i, j int) bool {
+		return snapshotTimeBefore(stashes[j].Name, stashes[i].Name)
+	})
+	return stashes, nil
+}
+
+
+func viewStashes(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectName := vars["proj"]
+	renderStashes(w, projectName, nil)
+}
+
+
+func renderStashes(w http.ResponseWriter, projectName string, applied []MergeConflict) {
+	projects, err := getAllProjects()
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	stashes, err := getStashes(projectName)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+
+	type Context struct {
+		Projects []string
+		CurrentProject string
+		Stashes []Stash
+		Applied bool
+		Conflicts []MergeConflict
+		SnapshotTime func(s string) string
+	}
+	st := func(s string) string {
+		timeParsed, err :=  time.Parse(VersionFormat, s)
+		if err != nil {
+			return ""
+		}
+		return timeParsed.String()
+	}
+	tmpl := template.Must(template.ParseFS(content, "templates/base.html", "templates/stashes.html"))
+	tmpl.Execute(w, Context{projects, projectName, stashes, applied != nil, applied, st})
+}
+
+
+// applyStash merges a stash into the project folder. Text files changed by both
+// are merged with conflict markers; for other conflicts the project folder's
+// version is kept and the stash's is saved beside it with a .stashed extension.
+func applyStash(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectName := vars["proj"]
+	stashName := vars["name"]
+	rootPath, _ := GetRootPath()
+	stashPath := filepath.Join(getStashesPath(projectName), filepath.Base(stashName))
+
+	if DoesPathExists(filepath.Join(rootPath, "p", projectName, ".merging_details.txt")) {
+		errorPage(w, errors.New("Merging in progress. Cannot currently apply a stash."))
+		return
+	}
+	raw, err := os.ReadFile(filepath.Join(stashPath, "stash.json"))
+	if err != nil {
+		errorPage(w, errors.Wrap(err, "os error"))
+		return
+	}
+	var stash Stash
+	err = json.Unmarshal(raw, &stash)
+	if err != nil {
+		errorPage(w, errors.Wrap(err, "json error"))
+		return
+	}
+
+	pd, err := getProjectData(projectName)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	userData, err := getUserData()
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	store, err := getStore(pd)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	snapshots, err := getManifest(store, userData.Email)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	baseSnapshot := findSnapshot(snapshots, stash.BaseSnapshot)
+	if baseSnapshot == nil {
+		errorPage(w, errors.New("The snapshot " + stash.BaseSnapshot + " the stash was made on does not exist."))
+		return
+	}
+	basePath, release, err := getCachedSnapshot(store, projectName, userData.Email, baseSnapshot.Name, baseSnapshot.Hash)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	defer release()
+
+	workPath := filepath.Join(rootPath, "flotmp", UntestedRandomString(10))
+	defer os.RemoveAll(workPath)
+	yoursPath := filepath.Join(workPath, "yours")
+	finalPath := filepath.Join(workPath, "final")
+	fromYoursPath := filepath.Join(workPath, "from_yours")
+	fromStashPath := filepath.Join(workPath, "from_stash")
+	for _, p := range []string{yoursPath, finalPath, fromYoursPath, fromStashPath} {
+		os.MkdirAll(p, 0777)
+	}
+	err = copyWorkingTree(projectName, yoursPath)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+
+	conflicts, err := threeWayMerge(basePath, yoursPath, filepath.Join(stashPath, "files"), finalPath,
+		fromYoursPath, fromStashPath, "stash")
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	for _, conflict := range conflicts {
+		if ! conflict.Binary && conflict.DeletedBy == "" {
+			continue
+		}
+		for _, side := range []struct{from, to string} {
+			{filepath.Join(fromYoursPath, conflict.Path), filepath.Join(finalPath, conflict.Path)},
+			{filepath.Join(fromStashPath, conflict.Path), filepath.Join(finalPath, conflict.Path + ".stashed")},
+		} {
+			if DoesPathExists(side.from) {
+				err = copy.Copy(side.from, side.to)
+				if err != nil {
+					errorPage(w, errors.Wrap(err, "copy error"))
+					return
+				}
+			}
+		}
+	}
+
+	err = replaceWorkingTree(projectName, finalPath)
+	if err != nil {
+		errorPage(w, err)
+		return
+	}
+	renderStashes(w, projectName, conflicts)
+}
+
+
+func dropStash(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectName := vars["proj"]
+	stashName := vars["name"]
+
+	err := os.RemoveAll(filepath.Join(getStashesPath(projectName), filepath.Base(stashName)))
+	if err != nil {
+		errorPage(w, errors.Wrap(err, "os error"))
+		return
+	}
+	http.Redirect(w, r, "/stashes/" + projectName, 307)
+}